@@ -0,0 +1,74 @@
+// Package echo is the replying side shared by the commands that talk to tcp
+// transport endpoints.
+package echo
+
+import (
+	"github.com/lichengqian/mylang/net/transport/tcp"
+)
+
+// Replier sends messages back to the endpoints that connected to ep, over one
+// connection per peer that is dialed on first use. It is not safe for
+// concurrent use: it is meant for the goroutine that receives on ep.
+type Replier struct {
+	ep      *tcp.EndPoint
+	peers   map[tcp.ConnectionId]tcp.EndPointAddress
+	replies map[tcp.EndPointAddress]*tcp.Connection
+}
+
+// NewReplier returns a Replier for the messages arriving at ep.
+func NewReplier(ep *tcp.EndPoint) *Replier {
+	return &Replier{
+		ep:      ep,
+		peers:   make(map[tcp.ConnectionId]tcp.EndPointAddress),
+		replies: make(map[tcp.EndPointAddress]*tcp.Connection),
+	}
+}
+
+// Track keeps up with the connections of ev, and returns false once the
+// endpoint is closed.
+func (r *Replier) Track(ev tcp.Event) bool {
+	switch e := ev.(type) {
+	case *tcp.ConnectionOpened:
+		r.peers[e.ConnectionId()] = e.RemoteAddress()
+	case *tcp.ConnectionClosed:
+		delete(r.peers, e.ConnectionId())
+	case *tcp.ErrorEvent:
+		if lost, ok := e.Code().(*tcp.EventConnectionLost); ok {
+			r.forget(lost.RemoteAddress())
+		}
+	case tcp.EndPointClosed:
+		return false
+	}
+	return true
+}
+
+// From returns the endpoint e came from, if its connection is known.
+func (r *Replier) From(e *tcp.Received) (tcp.EndPointAddress, bool) {
+	to, ok := r.peers[e.ConnectionId()]
+	return to, ok
+}
+
+// Reply sends msg to the endpoint to. Send only queues msg, so it must not be
+// reused afterwards.
+func (r *Replier) Reply(to tcp.EndPointAddress, msg []byte) error {
+	conn, ok := r.replies[to]
+	if !ok {
+		var err error
+		if conn, err = r.ep.Dial(to); err != nil {
+			return err
+		}
+		r.replies[to] = conn
+	}
+	if _, err := conn.Send(msg); err != nil {
+		r.forget(to)
+		return err
+	}
+	return nil
+}
+
+func (r *Replier) forget(to tcp.EndPointAddress) {
+	if conn, ok := r.replies[to]; ok {
+		conn.Close()
+		delete(r.replies, to)
+	}
+}
@@ -0,0 +1,293 @@
+// Command mylang-transport talks to tcp transport endpoints by hand.
+//
+// Usage:
+//
+//	mylang-transport listen [-listen host:port] [-epid n]
+//	    print every event arriving at a new endpoint
+//	mylang-transport echo [-listen host:port] [-epid n]
+//	    send every received message back to its sender
+//	mylang-transport dial [-listen host:port] [-epid n] host:port:epid
+//	    send each line read from stdin to the remote endpoint
+//	mylang-transport ping [-listen host:port] [-epid n] [-count n] [-size n] host:port:epid
+//	    measure round trips against an echo endpoint
+//
+// The remote side must be able to connect back to -listen, so use an
+// address that is reachable from the peer when talking to another host.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/lichengqian/mylang/cmd/internal/echo"
+	"github.com/lichengqian/mylang/net/transport/tcp"
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(fs *flag.FlagSet, ep func() (*tcp.EndPoint, error)) error
+}
+
+var commands = []command{
+	{"listen", "", "print every event arriving at a new endpoint", runListen},
+	{"echo", "", "send every received message back to its sender", runEcho},
+	{"dial", "host:port:epid", "send each line read from stdin to the remote endpoint", runDial},
+	{"ping", "host:port:epid", "measure round trips against an echo endpoint", runPing},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mylang-transport <command> [flags] [address]")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-7s %-15s %s\n", c.name, c.args, c.usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+		listen := fs.String("listen", "127.0.0.1:0", "address of the local transport")
+		epid := fs.Uint("epid", 1000, "id of the local endpoint")
+		newEndPoint := func() (*tcp.EndPoint, error) {
+			tp, err := tcp.CreateTransport(*listen)
+			if err != nil {
+				return nil, err
+			}
+			return tp.NewEndPoint(tcp.EndPointId(*epid), nil)
+		}
+		if err := c.run(fs, newEndPoint); err != nil {
+			fmt.Fprintf(os.Stderr, "mylang-transport %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+}
+
+// remoteArg parses the single endpoint address argument of dial and ping.
+func remoteArg(fs *flag.FlagSet) (tcp.EndPointAddress, error) {
+	if fs.NArg() != 1 {
+		return tcp.EndPointAddress{}, errors.New("expected one endpoint address, host:port:epid")
+	}
+	return tcp.ParseEndPointAddress(fs.Arg(0))
+}
+
+func describe(ev tcp.Event) string {
+	switch e := ev.(type) {
+	case *tcp.ConnectionOpened:
+		return fmt.Sprintf("ConnectionOpened  conn=%d from=%s", e.ConnectionId(), e.RemoteAddress())
+	case *tcp.ConnectionClosed:
+		return fmt.Sprintf("ConnectionClosed  conn=%d", e.ConnectionId())
+	case *tcp.Received:
+		return fmt.Sprintf("Received          conn=%d len=%d %q", e.ConnectionId(), len(e.Payload()), e.Payload())
+	case *tcp.ErrorEvent:
+		if lost, ok := e.Code().(*tcp.EventConnectionLost); ok {
+			return fmt.Sprintf("ErrorEvent        %s peer=%s: %v", e.Code(), lost.RemoteAddress(), e.Err())
+		}
+		return fmt.Sprintf("ErrorEvent        %s: %v", e.Code(), e.Err())
+	default:
+		return ev.String()
+	}
+}
+
+func timestamp() string {
+	return time.Now().Format("15:04:05.000000")
+}
+
+func runListen(fs *flag.FlagSet, newEndPoint func() (*tcp.EndPoint, error)) error {
+	fs.Parse(os.Args[2:])
+	ep, err := newEndPoint()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "listening on", ep.Address())
+	for {
+		ev := ep.Receive()
+		fmt.Println(timestamp(), describe(ev))
+		if _, ok := ev.(tcp.EndPointClosed); ok {
+			return nil
+		}
+	}
+}
+
+func runEcho(fs *flag.FlagSet, newEndPoint func() (*tcp.EndPoint, error)) error {
+	fs.Parse(os.Args[2:])
+	ep, err := newEndPoint()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "echoing on", ep.Address())
+
+	replier := echo.NewReplier(ep)
+	for {
+		ev := ep.Receive()
+		fmt.Println(timestamp(), describe(ev))
+		if e, ok := ev.(*tcp.Received); ok {
+			if to, ok := replier.From(e); ok {
+				if err := replier.Reply(to, e.Payload()); err != nil {
+					fmt.Println(timestamp(), "echo to", to, "failed:", err)
+				}
+			}
+		}
+		if !replier.Track(ev) {
+			return nil
+		}
+	}
+}
+
+func runDial(fs *flag.FlagSet, newEndPoint func() (*tcp.EndPoint, error)) error {
+	fs.Parse(os.Args[2:])
+	remote, err := remoteArg(fs)
+	if err != nil {
+		return err
+	}
+	ep, err := newEndPoint()
+	if err != nil {
+		return err
+	}
+	conn, err := ep.Dial(remote)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "connected", ep.Address(), "->", remote)
+
+	// show whatever the peer sends back while we are talking to it
+	go func() {
+		for {
+			ev := ep.Receive()
+			fmt.Println(timestamp(), describe(ev))
+			if _, ok := ev.(tcp.EndPointClosed); ok {
+				return
+			}
+		}
+	}()
+
+	lines := bufio.NewScanner(os.Stdin)
+	for lines.Scan() {
+		if _, err := conn.Send([]byte(lines.Text())); err != nil {
+			return err
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	// a graceful close waits until the peer has everything we queued
+	conn.Close()
+	return ep.Close()
+}
+
+func runPing(fs *flag.FlagSet, newEndPoint func() (*tcp.EndPoint, error)) error {
+	count := fs.Int("count", 10, "number of pings, 0 for no limit (stop with an interrupt)")
+	size := fs.Int("size", 64, "size of each ping in bytes (at least 8)")
+	interval := fs.Duration("interval", time.Second, "time between pings")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each reply")
+	fs.Parse(os.Args[2:])
+	remote, err := remoteArg(fs)
+	if err != nil {
+		return err
+	}
+	if *size < 8 {
+		*size = 8
+	}
+
+	ep, err := newEndPoint()
+	if err != nil {
+		return err
+	}
+	conn, err := ep.Dial(remote)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	replies := make(chan uint64, 16)
+	go func() {
+		for {
+			switch e := ep.Receive().(type) {
+			case *tcp.Received:
+				if len(e.Payload()) >= 8 {
+					replies <- binary.BigEndian.Uint64(e.Payload())
+				}
+				e.Release()
+			case *tcp.ErrorEvent:
+				fmt.Println(timestamp(), describe(e))
+			case tcp.EndPointClosed:
+				return
+			}
+		}
+	}()
+
+	// an interrupt ends the pings, with the statistics so far
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	fmt.Printf("PING %s from %s: %d bytes\n", remote, ep.Address(), *size)
+	var rtts []time.Duration
+	sent := 0
+pings:
+	for seq := uint64(1); *count == 0 || seq <= uint64(*count); seq++ {
+		if seq > 1 {
+			select {
+			case <-time.After(*interval):
+			case <-interrupt:
+				break pings
+			}
+		}
+		msg := make([]byte, *size)
+		binary.BigEndian.PutUint64(msg, seq)
+		start := time.Now()
+		if _, err := conn.Send(msg); err != nil {
+			return err
+		}
+		sent++
+
+		deadline := time.After(*timeout)
+	wait:
+		for {
+			select {
+			case got := <-replies:
+				if got != seq {
+					continue // a late reply to an earlier ping
+				}
+				rtt := time.Since(start)
+				rtts = append(rtts, rtt)
+				fmt.Printf("%d bytes from %s: seq=%d time=%v\n", *size, remote, seq, rtt)
+				break wait
+			case <-deadline:
+				fmt.Printf("seq=%d timed out after %v\n", seq, *timeout)
+				break wait
+			case <-interrupt:
+				break pings
+			}
+		}
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", remote)
+	fmt.Printf("%d sent, %d received, %.1f%% loss\n", sent, len(rtts), 100*float64(sent-len(rtts))/float64(sent))
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		var total time.Duration
+		for _, rtt := range rtts {
+			total += rtt
+		}
+		fmt.Printf("rtt min/avg/median/max = %v/%v/%v/%v\n",
+			rtts[0], total/time.Duration(len(rtts)), rtts[len(rtts)/2], rtts[len(rtts)-1])
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lichengqian/mylang/net/transport/tcp"
+)
+
+// Result is one row of benchmark output.
+type Result struct {
+	Bench       string  `json:"bench"`
+	Size        int     `json:"size"`
+	Concurrency int     `json:"concurrency"`
+	Conns       int     `json:"conns"`
+	Peers       int     `json:"peers"`
+	Messages    int     `json:"messages"`
+	Seconds     float64 `json:"seconds"`
+	MsgsPerSec  float64 `json:"msgs_per_sec"`
+	MBPerSec    float64 `json:"mb_per_sec"`
+	SetupMs     float64 `json:"setup_ms,omitempty"`
+	P50us       float64 `json:"p50_us,omitempty"`
+	P90us       float64 `json:"p90_us,omitempty"`
+	P99us       float64 `json:"p99_us,omitempty"`
+	Maxus       float64 `json:"max_us,omitempty"`
+}
+
+func (r *Result) rates(elapsed time.Duration) {
+	r.Seconds = elapsed.Seconds()
+	r.MsgsPerSec = float64(r.Messages) / r.Seconds
+	r.MBPerSec = float64(r.Messages) * float64(r.Size) / r.Seconds / (1 << 20)
+}
+
+func (r *Result) percentiles(rtts []time.Duration) {
+	if len(rtts) == 0 {
+		return
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	at := func(p float64) float64 {
+		i := int(p * float64(len(rtts)-1))
+		return float64(rtts[i]) / float64(time.Microsecond)
+	}
+	r.P50us, r.P90us, r.P99us, r.Maxus = at(0.50), at(0.90), at(0.99), at(1)
+}
+
+// peer is a client endpoint. A single goroutine drains its receive queue and
+// hands every reply to the worker named in the reply header.
+type peer struct {
+	ep *tcp.EndPoint
+
+	sync.Mutex
+	waiting map[uint32]chan []byte
+}
+
+func newPeer(tp *tcp.Transport) (*peer, error) {
+	ep, err := tp.NewEndPoint(tcp.AnyEndPointId, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{ep: ep, waiting: make(map[uint32]chan []byte)}
+	go p.dispatch()
+	return p, nil
+}
+
+func (p *peer) dispatch() {
+	for {
+		switch e := p.ep.Receive().(type) {
+		case *tcp.Received:
+			_, worker, _, ok := parseHeader(e.Payload())
+			p.Lock()
+			ch := p.waiting[worker]
+			p.Unlock()
+			if ok && ch != nil {
+				// a worker that gave up waiting has a reply in the way
+				select {
+				case ch <- e.Payload():
+				default:
+				}
+			}
+		case *tcp.ErrorEvent:
+			fmt.Println("tcpbench:", e.Code(), e.Err())
+		case tcp.EndPointClosed:
+			return
+		}
+	}
+}
+
+func (p *peer) replies(worker uint32) chan []byte {
+	ch := make(chan []byte, 1)
+	p.Lock()
+	p.waiting[worker] = ch
+	p.Unlock()
+	return ch
+}
+
+// sync sends a kindSync message on conn and waits until the server has seen
+// everything sent on conn before it.
+func (p *peer) sync(conn *tcp.Connection, worker uint32, ch chan []byte, timeout time.Duration) error {
+	if _, err := conn.Send(newMessage(headerLen, kindSync, worker, 0)); err != nil {
+		return err
+	}
+	return await(ch, timeout)
+}
+
+// await waits for the next reply on ch.
+func await(ch chan []byte, timeout time.Duration) error {
+	select {
+	case <-ch:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no reply within %v", timeout)
+	}
+}
+
+// benchLatency runs cfg.concurrency ping-pong loops, each on its own
+// lightweight connection, and reports round-trip percentiles.
+func benchLatency(cfg *config, p *peer, server tcp.EndPointAddress, size int) (*Result, error) {
+	conns, err := dialN(p, server, cfg.concurrency)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll(conns)
+
+	perWorker := cfg.count / cfg.concurrency
+	rtts := make([][]time.Duration, cfg.concurrency)
+	errs := make(chan error, cfg.concurrency)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := range conns {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ch := p.replies(uint32(w))
+			msg := newMessage(size, kindEcho, uint32(w), 0)
+			for i := 0; i < perWorker; i++ {
+				t0 := time.Now()
+				if _, err := conns[w].Send(msg); err != nil {
+					errs <- err
+					return
+				}
+				if err := await(ch, cfg.timeout); err != nil {
+					errs <- err
+					return
+				}
+				rtts[w] = append(rtts[w], time.Since(t0))
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	r := &Result{Bench: "latency", Size: size, Concurrency: cfg.concurrency, Conns: cfg.concurrency, Peers: 1,
+		Messages: perWorker * cfg.concurrency}
+	r.rates(elapsed)
+	var all []time.Duration
+	for _, ds := range rtts {
+		all = append(all, ds...)
+	}
+	r.percentiles(all)
+	return r, nil
+}
+
+// benchThroughput sends cfg.count one-way messages spread over conns
+// lightweight connections per peer, from every given peer at once.
+func benchThroughput(cfg *config, name string, peers []*peer, server tcp.EndPointAddress, size, conns int) (*Result, error) {
+	setup := time.Now()
+	perPeer := make([][]*tcp.Connection, len(peers))
+	for i, p := range peers {
+		cs, err := dialN(p, server, conns)
+		if err != nil {
+			return nil, err
+		}
+		defer closeAll(cs)
+		perPeer[i] = cs
+	}
+	setupTime := time.Since(setup)
+
+	perConn := cfg.count / (len(peers) * conns)
+	errs := make(chan error, len(peers)*conns)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		for c, conn := range perPeer[i] {
+			wg.Add(1)
+			go func(p *peer, worker uint32, conn *tcp.Connection) {
+				defer wg.Done()
+				ch := p.replies(worker)
+				msg := newMessage(size, kindSink, worker, 0)
+				for n := 0; n < perConn; n++ {
+					if _, err := conn.Send(msg); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if err := p.sync(conn, worker, ch, cfg.timeout); err != nil {
+					errs <- err
+				}
+			}(p, uint32(c), conn)
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	r := &Result{Bench: name, Size: size, Concurrency: len(peers) * conns, Conns: conns, Peers: len(peers),
+		Messages: perConn * len(peers) * conns,
+		SetupMs:  float64(setupTime) / float64(time.Millisecond)}
+	r.rates(elapsed)
+	return r, nil
+}
+
+func dialN(p *peer, server tcp.EndPointAddress, n int) ([]*tcp.Connection, error) {
+	conns := make([]*tcp.Connection, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := p.ep.Dial(server)
+		if err != nil {
+			closeAll(conns)
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func closeAll(conns []*tcp.Connection) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,239 @@
+// Command tcpbench measures the tcp transport through its public API.
+//
+// By default it runs a server and a client transport in one process on
+// loopback:
+//
+//	tcpbench -bench latency,throughput -size 64,4096 -concurrency 8
+//
+// To measure across processes or hosts, start a server and point a client at
+// the endpoint address it prints:
+//
+//	tcpbench -mode server -listen 0.0.0.0:9999
+//	tcpbench -mode client -listen 0.0.0.0:0 -peer 10.0.0.1:9999:1000
+//
+// Benchmarks:
+//
+//	latency     round trips on -concurrency connections, with percentiles
+//	throughput  one-way messages from one peer over one connection
+//	conns       one-way messages from one peer spread over -conns connections
+//	fanin       one-way messages from -peers peers into one endpoint
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lichengqian/mylang/net/transport/tcp"
+)
+
+type config struct {
+	mode        string
+	listen      string
+	peer        string
+	epid        uint
+	benches     []string
+	sizes       []int
+	count       int
+	concurrency int
+	conns       int
+	peers       int
+	timeout     time.Duration
+	throttled   bool
+	stripes     int
+	json        bool
+	out         string
+}
+
+func parseFlags() (*config, error) {
+	cfg := &config{}
+	var benches, sizes string
+	flag.StringVar(&cfg.mode, "mode", "loopback", "loopback, server or client")
+	flag.StringVar(&cfg.listen, "listen", "127.0.0.1:0", "address of the local transport")
+	flag.StringVar(&cfg.peer, "peer", "", "server endpoint address (client mode), host:port:epid")
+	flag.UintVar(&cfg.epid, "epid", 1000, "endpoint id of the server endpoint")
+	flag.StringVar(&benches, "bench", "latency,throughput,conns,fanin", "comma separated benchmarks to run")
+	flag.StringVar(&sizes, "size", "64,1024,65536", "comma separated message sizes in bytes")
+	flag.IntVar(&cfg.count, "count", 100000, "messages per benchmark")
+	flag.IntVar(&cfg.concurrency, "concurrency", 1, "concurrent ping-pong loops for latency")
+	flag.IntVar(&cfg.conns, "conns", 64, "lightweight connections per peer for conns")
+	flag.IntVar(&cfg.peers, "peers", 16, "peers for fanin")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "time to wait for each reply")
+	flag.BoolVar(&cfg.throttled, "throttled", false, "use throttled flushing")
+	flag.IntVar(&cfg.stripes, "stripes", 1, "sockets per peer")
+	flag.BoolVar(&cfg.json, "json", false, "print results as JSON")
+	flag.StringVar(&cfg.out, "o", "", "write results to this file instead of stdout")
+	flag.Parse()
+
+	for _, b := range strings.Split(benches, ",") {
+		switch b = strings.TrimSpace(b); b {
+		case "latency", "throughput", "conns", "fanin":
+			cfg.benches = append(cfg.benches, b)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown benchmark %q", b)
+		}
+	}
+	for _, s := range strings.Split(sizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid message size %q", s)
+		}
+		cfg.sizes = append(cfg.sizes, n)
+	}
+	if cfg.count <= 0 || cfg.concurrency <= 0 || cfg.conns <= 0 || cfg.peers <= 0 || cfg.timeout <= 0 {
+		return nil, fmt.Errorf("-count, -concurrency, -conns, -peers and -timeout must be positive")
+	}
+	return cfg, nil
+}
+
+func (cfg *config) transportOptions() []tcp.TransportOption {
+	opts := []tcp.TransportOption{tcp.WithStripes(cfg.stripes)}
+	if cfg.throttled {
+		opts = append(opts, tcp.WithThrottledFlush())
+	}
+	return opts
+}
+
+func startServer(cfg *config) (tcp.EndPointAddress, error) {
+	tp, err := tcp.CreateTransport(cfg.listen, cfg.transportOptions()...)
+	if err != nil {
+		return tcp.EndPointAddress{}, err
+	}
+	ep, err := tp.NewEndPoint(tcp.EndPointId(cfg.epid), nil)
+	if err != nil {
+		return tcp.EndPointAddress{}, err
+	}
+	go serve(ep)
+	return ep.Address(), nil
+}
+
+func runClient(cfg *config, server tcp.EndPointAddress) ([]*Result, error) {
+	tp, err := tcp.CreateTransport(cfg.listen, cfg.transportOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	newPeers := func(n int) ([]*peer, error) {
+		peers := make([]*peer, n)
+		for i := range peers {
+			p, err := newPeer(tp)
+			if err != nil {
+				return nil, err
+			}
+			peers[i] = p
+		}
+		return peers, nil
+	}
+
+	var results []*Result
+	for _, bench := range cfg.benches {
+		for _, size := range cfg.sizes {
+			var r *Result
+			var err error
+			switch bench {
+			case "latency":
+				var peers []*peer
+				if peers, err = newPeers(1); err == nil {
+					r, err = benchLatency(cfg, peers[0], server, size)
+				}
+			case "throughput":
+				var peers []*peer
+				if peers, err = newPeers(1); err == nil {
+					r, err = benchThroughput(cfg, bench, peers, server, size, 1)
+				}
+			case "conns":
+				var peers []*peer
+				if peers, err = newPeers(1); err == nil {
+					r, err = benchThroughput(cfg, bench, peers, server, size, cfg.conns)
+				}
+			case "fanin":
+				var peers []*peer
+				if peers, err = newPeers(cfg.peers); err == nil {
+					r, err = benchThroughput(cfg, bench, peers, server, size, 1)
+				}
+			}
+			if err != nil {
+				return results, fmt.Errorf("%s/%d: %v", bench, size, err)
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func writeTable(w io.Writer, results []*Result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "bench\tsize\tconc\tconns\tpeers\tmsgs\tmsg/s\tMB/s\tsetup ms\tp50 us\tp90 us\tp99 us\tmax us\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%.0f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			r.Bench, r.Size, r.Concurrency, r.Conns, r.Peers, r.Messages, r.MsgsPerSec, r.MBPerSec,
+			r.SetupMs, r.P50us, r.P90us, r.P99us, r.Maxus)
+	}
+	tw.Flush()
+}
+
+func main() {
+	cfg, err := parseFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tcpbench:", err)
+		os.Exit(2)
+	}
+
+	var server tcp.EndPointAddress
+	switch cfg.mode {
+	case "server":
+		addr, err := startServer(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tcpbench:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "tcpbench: serving on", addr)
+		select {}
+	case "client":
+		if server, err = tcp.ParseEndPointAddress(cfg.peer); err != nil {
+			fmt.Fprintln(os.Stderr, "tcpbench:", err)
+			os.Exit(2)
+		}
+	case "loopback":
+		cfg.listen = "127.0.0.1:0"
+		if server, err = startServer(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "tcpbench:", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "tcpbench: unknown mode", cfg.mode)
+		os.Exit(2)
+	}
+
+	results, runErr := runClient(cfg, server)
+
+	out := os.Stdout
+	if cfg.out != "" {
+		if out, err = os.Create(cfg.out); err != nil {
+			fmt.Fprintln(os.Stderr, "tcpbench:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.json {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		writeTable(out, results)
+	}
+	if out != os.Stdout {
+		out.Close()
+	}
+
+	if runErr != nil {
+		fmt.Fprintln(os.Stderr, "tcpbench:", runErr)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/lichengqian/mylang/cmd/internal/echo"
+	"github.com/lichengqian/mylang/net/transport/tcp"
+)
+
+// Every benchmark message starts with a header:
+//
+//	kind    uint8
+//	worker  uint32   which client goroutine is waiting for the reply
+//	seq     uint32
+//
+// and is padded with zeros up to the requested message size.
+const headerLen = 9
+
+const (
+	kindEcho uint8 = iota // reply with the whole message
+	kindSink              // count it, no reply
+	kindSync              // reply with a bare header once everything before it arrived
+)
+
+func newMessage(size int, kind uint8, worker, seq uint32) []byte {
+	if size < headerLen {
+		size = headerLen
+	}
+	msg := make([]byte, size)
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:5], worker)
+	binary.BigEndian.PutUint32(msg[5:9], seq)
+	return msg
+}
+
+func parseHeader(msg []byte) (kind uint8, worker, seq uint32, ok bool) {
+	if len(msg) < headerLen {
+		return 0, 0, 0, false
+	}
+	return msg[0], binary.BigEndian.Uint32(msg[1:5]), binary.BigEndian.Uint32(msg[5:9]), true
+}
+
+// serve runs the echo/sink side of the benchmarks on ep until it is closed.
+func serve(ep *tcp.EndPoint) {
+	replier := echo.NewReplier(ep)
+	reply := func(to tcp.EndPointAddress, msg []byte) {
+		if err := replier.Reply(to, msg); err != nil {
+			fmt.Println("tcpbench: reply to", to, "failed:", err)
+		}
+	}
+
+	for {
+		ev := ep.Receive()
+		if e, ok := ev.(*tcp.Received); ok {
+			to, known := replier.From(e)
+			kind, worker, seq, ok := parseHeader(e.Payload())
+			switch {
+			case !known || !ok:
+				e.Release()
+			case kind == kindEcho:
+				// Send only queues the payload, so it can not be released here
+				reply(to, e.Payload())
+			case kind == kindSync:
+				reply(to, newMessage(headerLen, kindSync, worker, seq))
+				e.Release()
+			default:
+				e.Release()
+			}
+		}
+		if !replier.Track(ev) {
+			return
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+Delivery acknowledgements are cumulative, per lightweight connection. The
+sender numbers the messages it queues on a connection 1, 2, ... and the
+receiver counts the messages of the connection it has put on its endpoint's
+receive queue. Acknowledgements are optional: the receiver only reports its
+count once the sender asked for it,
+
+	AckRequest lcid          acknowledge this connection from now on
+	Ack        lcid n        n messages of the connection have been enqueued
+
+and then reports it whenever it has caught up with its socket, so a burst of
+messages costs a single Ack, or has enqueued maxUnreportedAcks messages
+without catching up.
+*/
+
+// maxUnreportedAcks bounds the messages the receiver enqueues before it
+// reports, for a socket that never runs dry.
+const maxUnreportedAcks = 256
+
+var errAcksLost = errors.New("connection lost before the message was acknowledged")
+
+// Acks is the sending side of the acknowledgements of one lightweight
+// connection.
+type Acks struct {
+	mtx     sync.Mutex
+	changed chan struct{} // closed and replaced whenever acked or err changes
+	sent    uint64        // messages queued on the connection
+	acked   uint64        // messages the peer reported as enqueued
+	asked   bool          // whether the peer was asked to acknowledge
+	err     error
+}
+
+func newAcks() *Acks {
+	return resumeAcks(0)
+}
+
+// resumeAcks starts counting after message n, for a connection that carries
+// on where another one left off.
+func resumeAcks(n uint64) *Acks {
+	return &Acks{changed: make(chan struct{}), sent: n, acked: n}
+}
+
+// queued numbers the next message on the connection. It must be called in the
+// same critical section that queues the message, so that the numbers follow
+// the order on the wire.
+func (acks *Acks) queued() uint64 {
+	acks.mtx.Lock()
+	defer acks.mtx.Unlock()
+
+	acks.sent++
+	return acks.sent
+}
+
+// ask returns true the first time it is called: the caller should then send
+// the AckRequest.
+func (acks *Acks) ask() bool {
+	acks.mtx.Lock()
+	defer acks.mtx.Unlock()
+
+	if acks.asked {
+		return false
+	}
+	acks.asked = true
+	return true
+}
+
+// unask undoes ask when the AckRequest could not be sent, for the next call to
+// send it.
+func (acks *Acks) unask() {
+	acks.mtx.Lock()
+	defer acks.mtx.Unlock()
+
+	acks.asked = false
+}
+
+func (acks *Acks) ack(n uint64) {
+	acks.mtx.Lock()
+	defer acks.mtx.Unlock()
+
+	if n > acks.acked {
+		acks.acked = n
+		close(acks.changed)
+		acks.changed = make(chan struct{})
+	}
+}
+
+func (acks *Acks) fail(err error) {
+	acks.mtx.Lock()
+	defer acks.mtx.Unlock()
+
+	if acks.err == nil {
+		acks.err = err
+		close(acks.changed)
+		acks.changed = make(chan struct{})
+	}
+}
+
+// wait returns once message seq has been acknowledged, the connection failed
+// or ctx is done.
+func (acks *Acks) wait(ctx context.Context, seq uint64) error {
+	for {
+		acks.mtx.Lock()
+		acked, err, changed := acks.acked, acks.err, acks.changed
+		acks.mtx.Unlock()
+
+		if acked >= seq {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// advanced waits until more than n messages have been acknowledged and
+// returns how many, or the error once no more will be.
+func (acks *Acks) advanced(n uint64) (uint64, error) {
+	for {
+		acks.mtx.Lock()
+		acked, err, changed := acks.acked, acks.err, acks.changed
+		acks.mtx.Unlock()
+
+		if acked > n {
+			return acked, nil
+		}
+		if err != nil {
+			return acked, err
+		}
+		<-changed
+	}
+}
+
+func (acks *Acks) outstanding() int {
+	acks.mtx.Lock()
+	defer acks.mtx.Unlock()
+
+	return int(acks.sent - acks.acked)
+}
+
+// AckTable finds the Acks of our lightweight connections to one remote
+// endpoint when an Ack comes in.
+type AckTable struct {
+	sync.Mutex
+	conns  map[LightweightConnectionId]*Acks
+	failed error
+}
+
+func newAckTable() *AckTable {
+	return &AckTable{conns: make(map[LightweightConnectionId]*Acks)}
+}
+
+func (table *AckTable) add(lcid LightweightConnectionId, acks *Acks) {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.failed != nil {
+		acks.fail(table.failed)
+		return
+	}
+	table.conns[lcid] = acks
+}
+
+func (table *AckTable) remove(lcid LightweightConnectionId) {
+	table.Lock()
+	defer table.Unlock()
+
+	delete(table.conns, lcid)
+}
+
+func (table *AckTable) ack(lcid LightweightConnectionId, n uint64) {
+	table.Lock()
+	acks := table.conns[lcid]
+	table.Unlock()
+
+	if acks != nil {
+		acks.ack(n)
+	}
+}
+
+// fail wakes up everybody waiting for an acknowledgement; called when the
+// socket reader exits, since no Ack can arrive after that.
+func (table *AckTable) fail(err error) {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.failed != nil {
+		return
+	}
+	table.failed = err
+	for _, acks := range table.conns {
+		acks.fail(err)
+	}
+}
+
+// | Send a message and wait until the peer has put it on its receive queue
+func (ourEndPoint *LocalEndPoint) apiSendSync(ctx context.Context, theirEndPoint *RemoteEndPoint, connId LightweightConnectionId, msg []byte, connAlive *AtomicBool, acks *Acks) error {
+	var seq uint64
+	err := theirEndPoint.sendOnConnection(connAlive, func(vst *ValidRemoteEndPointState) {
+		seq = acks.queued()
+		vst.sendPayload(connId, len(msg), func(w io.Writer) {
+			connId.sendMsg(msg, w)
+		})
+		if acks.ask() {
+			vst.sendExpress(func(w io.Writer) {
+				sendAckRequest(uint32(connId), w)
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return acks.wait(ctx, seq)
+}
+
+// | Number of messages sent on a connection that the peer has not put on its
+// receive queue yet
+//
+// The first call asks the peer to acknowledge the connection.
+func (theirEndPoint *RemoteEndPoint) apiOutstanding(connId LightweightConnectionId, connAlive *AtomicBool, acks *Acks) int {
+	if acks.ask() {
+		err := theirEndPoint.sendOnConnection(connAlive, func(vst *ValidRemoteEndPointState) {
+			vst.sendExpress(func(w io.Writer) {
+				sendAckRequest(uint32(connId), w)
+			})
+		})
+		if err != nil {
+			acks.unask()
+		}
+	}
+	return acks.outstanding()
+}
+
+// incomingAcks is the receiving side: the socket reader counts the messages of
+// every incoming lightweight connection and owns this exclusively.
+type incomingAcks struct {
+	received map[LightweightConnectionId]uint64
+	acking   map[LightweightConnectionId]bool
+	dirty    map[LightweightConnectionId]struct{}
+	pending  int // messages enqueued since the last flush
+}
+
+func newIncomingAcks() *incomingAcks {
+	return &incomingAcks{
+		received: make(map[LightweightConnectionId]uint64),
+		acking:   make(map[LightweightConnectionId]bool),
+		dirty:    make(map[LightweightConnectionId]struct{}),
+	}
+}
+
+func (ia *incomingAcks) enqueued(lcid LightweightConnectionId) {
+	ia.received[lcid]++
+	ia.pending++
+	if ia.acking[lcid] {
+		ia.dirty[lcid] = struct{}{}
+	}
+}
+
+// delivered sets the count of lcid, for connections that carry a session and
+// count its messages rather than their own.
+func (ia *incomingAcks) delivered(lcid LightweightConnectionId, n uint64) {
+	ia.received[lcid] = n
+	ia.pending++
+	if ia.acking[lcid] {
+		ia.dirty[lcid] = struct{}{}
+	}
+}
+
+func (ia *incomingAcks) requested(lcid LightweightConnectionId) {
+	ia.acking[lcid] = true
+	ia.dirty[lcid] = struct{}{}
+}
+
+func (ia *incomingAcks) closed(lcid LightweightConnectionId) {
+	delete(ia.received, lcid)
+	delete(ia.acking, lcid)
+	delete(ia.dirty, lcid)
+}
+
+// due reports whether enough messages were enqueued since the last flush to
+// flush without catching up with the socket.
+func (ia *incomingAcks) due() bool {
+	return ia.pending >= maxUnreportedAcks
+}
+
+// flush reports the count of every acknowledged connection that received
+// messages since the last flush, on the sending side of the socket as it is
+// now, open or closing.
+func (ia *incomingAcks) flush(theirEndPoint *RemoteEndPoint) {
+	ia.pending = 0
+	if len(ia.dirty) == 0 {
+		return
+	}
+	theirState := &theirEndPoint.remoteState
+	theirState.Lock()
+	defer theirState.Unlock()
+
+	var vst *ValidRemoteEndPointState
+	switch st := theirState.value.(type) {
+	case *RemoteEndPointValid:
+		vst = &st._1
+	case *RemoteEndPointClosing:
+		vst = &st._2
+	default:
+		return
+	}
+	for lcid := range ia.dirty {
+		lcid, n := lcid, ia.received[lcid]
+		vst.sendExpress(func(w io.Writer) {
+			sendAck(uint32(lcid), n, w)
+		})
+		delete(ia.dirty, lcid)
+	}
+}
@@ -0,0 +1,100 @@
+package tcp
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSendPending is the result of a broadcast send that had not finished when
+// Broadcast returned.
+var ErrSendPending = errors.New("send still in progress")
+
+// BroadcastResult is what became of the send to one destination.
+type BroadcastResult struct {
+	To  EndPointAddress
+	Err error
+}
+
+// BroadcastOption adjusts when Broadcast returns.
+type BroadcastOption func(*broadcast)
+
+// WithWaitFor makes Broadcast return as soon as n sends have succeeded, or
+// once so many failed that n cannot; the sends left keep going. With 0 it
+// returns at once, with more than there are destinations once all have
+// finished.
+func WithWaitFor(n int) BroadcastOption {
+	return func(b *broadcast) {
+		b.waitFor = n
+	}
+}
+
+type broadcast struct {
+	waitFor int
+
+	sync.Mutex
+	results   []BroadcastResult
+	succeeded int
+	finished  int
+	returned  []BroadcastResult // results when done closed
+	done      chan struct{}     // closed when Broadcast may return
+}
+
+// Broadcast sends payload from localChannel to every endpoint of tos at once,
+// dialing those it has no connection to in parallel. It returns the result of
+// each send in the order of tos, once all have finished unless WithWaitFor
+// says otherwise. An endpoint given twice gets payload twice.
+func Broadcast(localChannel *LocalChannel, tos []EndPointAddress, payload []byte, opts ...BroadcastOption) []BroadcastResult {
+	b := &broadcast{
+		waitFor: len(tos),
+		results: make([]BroadcastResult, len(tos)),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.waitFor > len(tos) {
+		b.waitFor = len(tos)
+	}
+
+	// one goroutine per endpoint, for a single dial to each
+	byAddr := make(map[EndPointAddress][]int)
+	for i, to := range tos {
+		b.results[i] = BroadcastResult{to, ErrSendPending}
+		byAddr[to] = append(byAddr[to], i)
+	}
+	b.check()
+	for to, indices := range byAddr {
+		go func(to EndPointAddress, indices []int) {
+			for _, i := range indices {
+				b.finish(i, SendPayload(localChannel, to, payload))
+			}
+		}(to, indices)
+	}
+	<-b.done
+	return b.returned
+}
+
+func (b *broadcast) finish(i int, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.results[i].Err = err
+	b.finished++
+	if err == nil {
+		b.succeeded++
+	}
+	b.check()
+}
+
+// check closes done, with the results so far, once Broadcast may return; the
+// caller holds the lock, or is the only goroutine.
+func (b *broadcast) check() {
+	if b.returned != nil {
+		return
+	}
+	left := len(b.results) - b.finished
+	if left == 0 || b.succeeded >= b.waitFor || b.succeeded+left < b.waitFor {
+		b.returned = append([]BroadcastResult{}, b.results...)
+		close(b.done)
+	}
+}
@@ -0,0 +1,138 @@
+package tcp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Payload buffers for the receive path are drawn from size-classed free lists.
+Class i holds buffers with a capacity of exactly minPooledBufferSize << i. The
+classes reach up to the largest tcpMaxReceiveLength of any transport reading
+through the pool (growBufferClasses), but never past maxPooledBufferSize.
+Larger payloads are left to the garbage collector, as is anything that would
+take the idle buffers of all classes together past bufferPoolBudget. Empty
+payloads never touch the pool.
+
+The free lists are buffered channels rather than sync.Pools so that handing a
+slice back does not allocate.
+*/
+const (
+	minPooledBufferSize = 64
+	maxPooledBufferSize = bufferPoolBudget / 2
+	bufferPoolBudget    = 16 * 1024 * 1024
+	maxBuffersPerClass  = 1024
+)
+
+var (
+	bufferClasses atomic.Pointer[[]chan []byte]
+	// guards growing bufferClasses
+	bufferClassesLock sync.Mutex
+	// bytes held by idle buffers across all classes
+	bufferPoolIdle atomic.Int64
+)
+
+func init() {
+	growBufferClasses(defaultTCPParameters.tcpMaxReceiveLength)
+}
+
+// growBufferClasses adds the classes needed to pool payloads of up to limit
+// bytes. Existing classes, and the buffers they hold, are kept.
+func growBufferClasses(limit uint32) {
+	bufferClassesLock.Lock()
+	defer bufferClassesLock.Unlock()
+	var classes []chan []byte
+	if old := bufferClasses.Load(); old != nil {
+		classes = *old
+	}
+	size := minPooledBufferSize << uint(len(classes))
+	if uint32(size>>1) >= limit && classes != nil || size > maxPooledBufferSize {
+		return
+	}
+	classes = append([]chan []byte{}, classes...)
+	for ; uint32(size>>1) < limit && size <= maxPooledBufferSize; size <<= 1 {
+		n := bufferPoolBudget / size
+		if n > maxBuffersPerClass {
+			n = maxBuffersPerClass
+		}
+		classes = append(classes, make(chan []byte, n))
+	}
+	bufferClasses.Store(&classes)
+}
+
+// bufferClass returns the index of the smallest class holding n bytes, or -1
+// if n is too large to be pooled.
+func bufferClass(classes []chan []byte, n int) int {
+	size, class := minPooledBufferSize, 0
+	for size < n {
+		size <<= 1
+		class++
+	}
+	if class >= len(classes) {
+		return -1
+	}
+	return class
+}
+
+// getBuffer returns a slice of length n, taken from the pool when possible.
+func getBuffer(n uint32) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	classes := *bufferClasses.Load()
+	class := bufferClass(classes, int(n))
+	if class < 0 {
+		return make([]byte, n)
+	}
+	select {
+	case buf := <-classes[class]:
+		bufferPoolIdle.Add(-int64(cap(buf)))
+		return buf[:n]
+	default:
+		return make([]byte, n, minPooledBufferSize<<uint(class))
+	}
+}
+
+// putBuffer hands a slice obtained from getBuffer back to the pool. Slices
+// whose capacity does not match a class exactly are dropped, and so is
+// anything past the budget.
+func putBuffer(buf []byte) {
+	classes := *bufferClasses.Load()
+	class := bufferClass(classes, cap(buf))
+	if class < 0 || cap(buf) != minPooledBufferSize<<uint(class) {
+		return
+	}
+	size := int64(cap(buf))
+	if bufferPoolIdle.Add(size) > bufferPoolBudget {
+		bufferPoolIdle.Add(-size)
+		return
+	}
+	select {
+	case classes[class] <- buf[:0]:
+	default:
+		bufferPoolIdle.Add(-size)
+	}
+}
+
+var receivedPool = sync.Pool{
+	New: func() interface{} { return new(Received) },
+}
+
+func newReceived(cid ConnectionId, payload []byte) *Received {
+	event := receivedPool.Get().(*Received)
+	event._1, event._2 = cid, payload
+	return event
+}
+
+// Release hands the payload buffer (and the event itself) back to the
+// transport. It is optional: receivers that never call it simply leave both to
+// the garbage collector. Neither the event nor its payload may be used after
+// Release; calling it again right away does nothing.
+func (p *Received) Release() {
+	if p._2 == nil {
+		return
+	}
+	putBuffer(p._2)
+	p._2 = nil
+	receivedPool.Put(p)
+}
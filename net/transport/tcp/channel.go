@@ -0,0 +1,159 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+/*
+Closing a local channel closes its outgoing connections and, once nothing is
+being delivered to it any more, its Queue; what was queued can still be read.
+Later sends from the channel fail with ErrLocalChannelClosed.
+
+A message that arrives for a channel that is closed, or that never existed,
+is dropped, and the node controller of the sender is told (see the rejected
+signal in monitor.go). The sender forgets its connection, and its next send
+to that channel fails with ErrChannelRejected; the one after dials again.
+*/
+
+var (
+	ErrLocalChannelClosed = errors.New("local channel closed")
+	ErrChannelRejected    = errors.New("remote channel rejected our messages")
+	ErrReservedChannelID  = errors.New("channel id is reserved")
+)
+
+// The channel ids from firstTaskChannelID up belong to the node itself: the
+// node that runs a spawned function numbers its tasks from there, and the
+// top ones are its services.
+const (
+	firstTaskChannelID      ChannelID = 1 << 63
+	firstReservedChannelID  ChannelID = math.MaxUint64 - 255
+	spawnChannelID          ChannelID = math.MaxUint64 - 3 // see spawn.go
+	rpcChannelID            ChannelID = math.MaxUint64 - 2 // see rpc.go
+	nodeControllerChannelID ChannelID = math.MaxUint64 - 1 // see monitor.go
+	membershipChannelID     ChannelID = math.MaxUint64     // see membership.go
+)
+
+// NewLocalChannel opens channel sid on localNode. onConnect, if not nil, is
+// called when a peer connects to it, and must not block. The ids from
+// firstTaskChannelID up belong to the node and fail with
+// ErrReservedChannelID.
+func NewLocalChannel(localNode *LocalNode, sid ChannelID, onConnect func(EndPointAddress)) (*LocalChannel, error) {
+	if sid >= firstTaskChannelID {
+		return nil, fmt.Errorf("%w: %d", ErrReservedChannelID, sid)
+	}
+	return newLocalChannel(localNode, sid, onConnect)
+}
+
+// QueueGate guards the Queue of a LocalChannel, so that it is closed only
+// when nothing is sending to it.
+type QueueGate struct {
+	sync.RWMutex
+	closed bool
+	stop   sync.Once
+	done   chan struct{} // closed first, to get blocked senders out
+}
+
+func newQueueGate() *QueueGate {
+	return &QueueGate{done: make(chan struct{})}
+}
+
+// deliver queues msg, as the overflow policy of the channel says, unless the
+// channel is closed.
+func (localChannel *LocalChannel) deliver(msg Message) bool {
+	gate := localChannel.queueGate
+	gate.RLock()
+	defer gate.RUnlock()
+
+	if gate.closed {
+		return false
+	}
+	localChannel.put(msg)
+	return true
+}
+
+// shutdown closes the connections of a channel that was removed, its Queue
+// and its peer events.
+func (localChannel *LocalChannel) shutdown(conns map[EndPointAddress]*Connection) {
+	gate := localChannel.queueGate
+	gate.stop.Do(func() { close(gate.done) })
+
+	// wait for the senders that saw done open
+	gate.Lock()
+	if !gate.closed {
+		gate.closed = true
+		close(localChannel.Queue)
+	}
+	gate.Unlock()
+	localChannel.peers.close()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// checkSend fails for a closed channel, and once for a remote channel that
+// rejected or dropped our messages.
+func (localChannel *LocalChannel) checkSend(to EndPointAddress) error {
+	gate := localChannel.queueGate
+	gate.RLock()
+	closed := gate.closed
+	gate.RUnlock()
+	if closed {
+		return ErrLocalChannelClosed
+	}
+
+	ref := ChannelRef{to, localChannel.channelID}
+	st := &localChannel.localNode.localState
+	st.Lock()
+	defer st.Unlock()
+
+	vst, ok := st.value.(*LocalNodeValid)
+	if !ok {
+		return ErrLocalNodeClosed
+	}
+	if _, rejected := vst._1.localRejected[ref]; rejected {
+		delete(vst._1.localRejected, ref)
+		return fmt.Errorf("%w: %v", ErrChannelRejected, ref)
+	}
+	if _, overflowed := vst._1.localOverflowed[ref]; overflowed {
+		delete(vst._1.localOverflowed, ref)
+		return fmt.Errorf("%w: %v", ErrChannelOverflow, ref)
+	}
+	return nil
+}
+
+// reject tells the node controller of from that its channel chanID reaches
+// nothing here.
+func (node *LocalNode) reject(from EndPointAddress, chanID ChannelID) {
+	node.post(from, encodeRejected(chanID))
+}
+
+// rejected drops our connection to a remote channel that turned it away.
+func (node *LocalNode) rejected(ident Identifier, chanID ChannelID) {
+	from, ok := ident.(EndPointAddress)
+	if !ok {
+		return
+	}
+	var conn *Connection
+	func() {
+		st := &node.localState
+		st.Lock()
+		defer st.Unlock()
+
+		if vst, ok := st.value.(*LocalNodeValid); ok {
+			if conns, ok := vst._1.localConnections[chanID]; ok {
+				conn = conns[from]
+				delete(conns, from)
+			}
+			if vst._1.localSwitches[chanID] != nil {
+				vst._1.localRejected[ChannelRef{from, chanID}] = struct{}{}
+			}
+		}
+	}()
+	if conn != nil {
+		conn.Close()
+	}
+}
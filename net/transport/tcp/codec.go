@@ -0,0 +1,238 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+/*
+A typed message is the tag of its type followed by the value, encoded by the
+serializer of the channel's codec:
+
+	tag value
+
+tag is a uint32. Tags are what senders and receivers agree on, not Go type
+names: a type keeps its tag for as long as its encoding stays compatible, and
+a new version that is not gets a new tag, so that both can be registered and
+served while services move over.
+*/
+
+// ErrUnknownTag is the error of a message whose type tag is not registered.
+var ErrUnknownTag = errors.New("unknown message tag")
+
+var errNoCodec = errors.New("local channel has no codec")
+
+// Serializer encodes values to bytes and back. Marshal and Unmarshal are
+// given pointers to the value.
+type Serializer interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	GobSerializer    Serializer = gobSerializer{}
+	JSONSerializer   Serializer = jsonSerializer{}
+	BinarySerializer Serializer = binarySerializer{}
+)
+
+type gobSerializer struct{}
+
+func (gobSerializer) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobSerializer) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// binarySerializer takes values that marshal themselves, strings, byte
+// slices, and fixed-size values as encoding/binary does, big-endian.
+type binarySerializer struct{}
+
+func (binarySerializer) Marshal(v any) ([]byte, error) {
+	switch x := v.(type) {
+	case encoding.BinaryMarshaler:
+		return x.MarshalBinary()
+	case *[]byte:
+		return *x, nil
+	case *string:
+		return []byte(*x), nil
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (binarySerializer) Unmarshal(data []byte, v any) error {
+	switch x := v.(type) {
+	case encoding.BinaryUnmarshaler:
+		return x.UnmarshalBinary(data)
+	case *[]byte:
+		*x = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*x = string(data)
+		return nil
+	}
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, v); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d bytes left over", r.Len())
+	}
+	return nil
+}
+
+// Codec maps Go types to tags and encodes messages with a serializer.
+type Codec struct {
+	serializer Serializer
+
+	sync.RWMutex
+	tags  map[reflect.Type]uint32
+	types map[uint32]reflect.Type
+}
+
+func NewCodec(serializer Serializer) *Codec {
+	return &Codec{
+		serializer: serializer,
+		tags:       make(map[reflect.Type]uint32),
+		types:      make(map[uint32]reflect.Type),
+	}
+}
+
+// Register gives the type of v (or what v points to) the tag.
+func (c *Codec) Register(tag uint32, v any) error {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return errors.New("register: nil has no type")
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if other, ok := c.types[tag]; ok {
+		return fmt.Errorf("register %v: tag %d is taken by %v", t, tag, other)
+	}
+	if other, ok := c.tags[t]; ok {
+		return fmt.Errorf("register %v: already registered as %d", t, other)
+	}
+	c.tags[t] = tag
+	c.types[tag] = t
+	return nil
+}
+
+// Encode encodes v, or what v points to, as a typed message.
+func (c *Codec) Encode(v any) ([]byte, error) {
+	val := reflect.ValueOf(v)
+	if !val.IsValid() {
+		return nil, errors.New("encode: nil has no type")
+	}
+	if val.Kind() == reflect.Pointer {
+		if val.IsNil() {
+			return nil, fmt.Errorf("encode: nil %v", val.Type())
+		}
+		val = val.Elem()
+	}
+	c.RLock()
+	tag, ok := c.tags[val.Type()]
+	c.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("encode: %v is not registered", val.Type())
+	}
+
+	// serializers get a pointer, for pointer receivers
+	p := reflect.New(val.Type())
+	p.Elem().Set(val)
+	body, err := c.serializer.Marshal(p.Interface())
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(msg, tag)
+	return append(msg, body...), nil
+}
+
+// Decode decodes a typed message into a value of its registered type.
+func (c *Codec) Decode(msg []byte) (any, error) {
+	if len(msg) < 4 {
+		return nil, errors.New("decode: message too short for a tag")
+	}
+	tag := binary.BigEndian.Uint32(msg)
+	c.RLock()
+	t, ok := c.types[tag]
+	c.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("decode: %w %d", ErrUnknownTag, tag)
+	}
+
+	p := reflect.New(t)
+	if err := c.serializer.Unmarshal(msg[4:], p.Interface()); err != nil {
+		return nil, fmt.Errorf("decode %v: %w", t, err)
+	}
+	return p.Elem().Interface(), nil
+}
+
+// SetCodec makes localChannel send and receive typed messages with codec.
+// Set it before the channel is used.
+func SetCodec(localChannel *LocalChannel, codec *Codec) {
+	localChannel.codec = codec
+}
+
+// SendTyped sends v, encoded by the codec of localChannel.
+func SendTyped(localChannel *LocalChannel, to EndPointAddress, v any) error {
+	if localChannel.codec == nil {
+		return errNoCodec
+	}
+	msg, err := localChannel.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return SendPayload(localChannel, to, msg)
+}
+
+// ReceiveTyped takes the next message from localChannel.Queue and decodes it
+// with the codec of localChannel. A message that does not decode is consumed
+// all the same, and its sender returned with the error.
+func ReceiveTyped(ctx context.Context, localChannel *LocalChannel) (EndPointAddress, any, error) {
+	if localChannel.codec == nil {
+		return EndPointAddress{}, nil, errNoCodec
+	}
+	select {
+	case msg, ok := <-localChannel.Queue:
+		if !ok {
+			return EndPointAddress{}, nil, errors.New("local channel closed")
+		}
+		v, err := localChannel.codec.Decode(msg.Payload)
+		return msg.From, v, err
+	case <-ctx.Done():
+		return EndPointAddress{}, nil, ctx.Err()
+	}
+}
@@ -1,8 +1,14 @@
 package tcp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type EndPointAddress struct {
@@ -16,16 +22,60 @@ func NewEndPointAddress(lAddr string, ep int) EndPointAddress {
 	return EndPointAddress{TransportAddr(lAddr), EndPointId(ep)}
 }
 
+// EndPointIds below FirstAllocatedEndPointId are reserved for well-known
+// services, which ask for them by number. The rest are handed out by
+// NewEndPoint(AnyEndPointId) and cannot be asked for.
+// RegistryEndPointId, the last well-known id, is taken by the transport's own
+// registry.
+const (
+	FirstAllocatedEndPointId EndPointId = 1 << 16
+	RegistryEndPointId       EndPointId = FirstAllocatedEndPointId - 1
+	AnyEndPointId            EndPointId = 1<<32 - 1
+)
+
+// ErrReservedEndPointId is returned by NewEndPoint for an explicit id in the
+// allocated range, which only AnyEndPointId hands out.
+var ErrReservedEndPointId = errors.New("endpoint id is in the allocated range")
+
 type Transport struct {
-	Close       func() error
+	Close func() error
+	// | Create an endpoint with the given id, or with the next free allocated
+	// id for AnyEndPointId.
+	//
+	// A given id must be below FirstAllocatedEndPointId (65536); larger ones,
+	// which older versions accepted, fail with ErrReservedEndPointId.
+	// Callers that used such ids should switch to a well-known id below it,
+	// or to AnyEndPointId plus Register and Lookup.
 	NewEndPoint func(EndPointId, ShakeHand) (*EndPoint, error)
-	Address     func() string
+	// | Let a closed endpoint's allocated id be handed out again. Ids are
+	// only reused once every fresh id has been used, and never without this.
+	ReleaseEndPointId func(EndPointId) error
+	// | Register a name for an endpoint of this transport, for peers to
+	// Lookup. The name goes away with the endpoint.
+	Register   func(string, *EndPoint) error
+	Unregister func(string) error
+	// | Find the endpoint registered as name on the transport at an address,
+	// asking its registry. Unknown names fail with a ConnectError whose
+	// Code is ConnectNotFound.
+	Lookup  func(context.Context, TransportAddr, string) (EndPointAddress, error)
+	Address func() string
 }
 
 type EndPoint struct {
+	// | Close the endpoint gracefully: flush what is queued, tell the peers
+	// and wait (up to the transport's close timeout) for them to hang up.
 	Close func() error
+	// | Close the endpoint abortively, dropping whatever is still queued.
+	CloseNow func() error
 	// | Create a new lightweight connection.
 	Dial func(remoteEP EndPointAddress) (*Connection, error)
+	// | Create a lightweight connection that survives the loss of its socket:
+	// unacknowledged messages are resent on a new socket and the peer drops
+	// the ones it already has, so every message is delivered once and in
+	// order while the connection lives. Once it fails, messages not yet
+	// acknowledged may or may not have arrived. The peer sees each new
+	// socket as a new connection.
+	DialReliable func(remoteEP EndPointAddress) (*Connection, error)
 	// | Endpoints have a single shared receive queue.
 	Receive func() Event
 	// | EndPointAddress of the endpoint.
@@ -35,14 +85,86 @@ type EndPoint struct {
 type Connection struct {
 	Close func() error
 	Send  func([]byte) (int, error)
+	// | Send everything read from the reader as one stream, in fragments, so
+	// that it is not bound by tcpMaxReceiveLength. The peer gets a
+	// ReceivedStream event. Returns once the peer has read (or closed) the
+	// whole stream; only one stream at a time may be sent on a connection.
+	SendStream func(io.Reader) (int64, error)
+	// | Send a message and wait until the peer has put it on its receive
+	// queue (or ctx is done). Messages sent before it on the connection have
+	// been enqueued by then too.
+	SendSync func(context.Context, []byte) error
+	// | Number of messages sent on the connection that the peer has not
+	// enqueued yet, as far as we know. Acknowledgements are only sent once
+	// SendSync or Outstanding has been used on the connection.
+	Outstanding func() int
 }
 
 func (conn *Connection) Write(bs []byte) (int, error) {
 	return conn.Send(bs)
 }
 
-func CreateTransport(lAddr string) (*Transport, error) {
-	transport, err := createTCPTransport(lAddr)
+// TransportOption adjusts the TCPParameters of a transport being created.
+type TransportOption func(*TCPParameters)
+
+// WithThrottledFlush makes heavyweight connections flush their write buffer
+// at most every flushThrottleMS instead of as soon as their send queue is
+// drained. This trades latency for fewer, larger writes.
+func WithThrottledFlush() TransportOption {
+	return func(params *TCPParameters) {
+		params.tcpFlushMode = FlushThrottled{}
+	}
+}
+
+// WithCloseTimeout bounds how long EndPoint.Close waits for queued messages to
+// be flushed and for peers to close their sockets.
+func WithCloseTimeout(timeout time.Duration) TransportOption {
+	return func(params *TCPParameters) {
+		params.tcpCloseTimeout = timeout
+	}
+}
+
+// WithStripes opens n sockets to every remote endpoint instead of one, so that
+// a single TCP stream does not cap throughput. Every lightweight connection
+// uses one of them, so messages on it stay in order.
+func WithStripes(n int) TransportOption {
+	return func(params *TCPParameters) {
+		if n < 1 {
+			n = 1
+		}
+		if n > maxStripes {
+			n = maxStripes
+		}
+		params.tcpStripes = uint32(n)
+	}
+}
+
+// WithRetransmitBuffer sets how many unacknowledged messages a reliable
+// connection keeps for resending; Send blocks while that many are
+// outstanding.
+func WithRetransmitBuffer(n int) TransportOption {
+	return func(params *TCPParameters) {
+		if n < 1 {
+			n = 1
+		}
+		params.tcpRetransmitBuffer = uint32(n)
+	}
+}
+
+// WithReconnectTimeout bounds how long a reliable connection tries to get a
+// new socket after losing one.
+func WithReconnectTimeout(timeout time.Duration) TransportOption {
+	return func(params *TCPParameters) {
+		params.tcpReconnectTimeout = timeout
+	}
+}
+
+func CreateTransport(lAddr string, opts ...TransportOption) (*Transport, error) {
+	params := *defaultTCPParameters
+	for _, opt := range opts {
+		opt(&params)
+	}
+	transport, err := createTCPTransport(lAddr, &params)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +179,18 @@ func (transport *TCPTransport) ToTransport() *Transport {
 		NewEndPoint: func(epid EndPointId, shake ShakeHand) (*EndPoint, error) {
 			return transport.apiNewEndPoint(epid, shake)
 		},
+		ReleaseEndPointId: func(epid EndPointId) error {
+			return transport.apiReleaseEndPointId(epid)
+		},
+		Register: func(name string, ep *EndPoint) error {
+			return transport.apiRegister(name, ep)
+		},
+		Unregister: func(name string) error {
+			return transport.apiUnregister(name)
+		},
+		Lookup: func(ctx context.Context, addr TransportAddr, name string) (EndPointAddress, error) {
+			return transport.transportRegistry.lookup(ctx, addr, name)
+		},
 		Address: func() string {
 			return string(transport.transportAddr)
 		},
@@ -66,3 +200,39 @@ func (transport *TCPTransport) ToTransport() *Transport {
 func (addr EndPointAddress) String() string {
 	return fmt.Sprintf("%s:%d", addr.TransportAddr, addr.EndPointId)
 }
+
+// ParseEndPointAddress parses the "host:port:epid" form produced by String().
+func ParseEndPointAddress(s string) (EndPointAddress, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return EndPointAddress{}, fmt.Errorf("endpoint address %q: missing endpoint id", s)
+	}
+	epid, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return EndPointAddress{}, fmt.Errorf("endpoint address %q: %v", s, err)
+	}
+	if _, _, err := net.SplitHostPort(s[:i]); err != nil {
+		return EndPointAddress{}, fmt.Errorf("endpoint address %q: %v", s, err)
+	}
+	return EndPointAddress{TransportAddr(s[:i]), EndPointId(epid)}, nil
+}
+
+//-----------------------------------------------------------------------------
+// Event accessors                                                           --
+//-----------------------------------------------------------------------------
+
+func (e *Received) ConnectionId() ConnectionId { return e._1 }
+func (e *Received) Payload() []byte            { return e._2 }
+
+func (e *ConnectionClosed) ConnectionId() ConnectionId { return e._1 }
+
+func (e *ReceivedStream) ConnectionId() ConnectionId { return e._1 }
+func (e *ReceivedStream) Stream() *StreamReader      { return e._2 }
+
+func (e *ConnectionOpened) ConnectionId() ConnectionId     { return e._1 }
+func (e *ConnectionOpened) RemoteAddress() EndPointAddress { return e._2 }
+
+func (e *ErrorEvent) Code() EventErrorCode { return e._1 }
+func (e *ErrorEvent) Err() error           { return e._2 }
+
+func (code *EventConnectionLost) RemoteAddress() EndPointAddress { return code._1 }
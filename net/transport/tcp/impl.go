@@ -1,10 +1,13 @@
 package tcp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 //------------------------------------------------------------------------------
@@ -16,15 +19,61 @@ func (tp *TCPTransport) apiCloseTransport(evs []Event) error {
 	return errors.New("not implemented")
 }
 
+// | Make the allocated id of a closed endpoint available again
+func (tp *TCPTransport) apiReleaseEndPointId(epid EndPointId) error {
+	tpState := &tp.transportState
+	tpState.Lock()
+	defer tpState.Unlock()
+
+	switch st := tpState.value.(type) {
+	case *TransPortValid:
+		vst := &st._1
+		if epid < FirstAllocatedEndPointId || epid >= vst._nextEndPointId {
+			return fmt.Errorf("endpoint id %d was not allocated", epid)
+		}
+		if _, ok := vst._localEndPoints[epid]; ok {
+			return fmt.Errorf("endpoint %d is not closed", epid)
+		}
+		if _, ok := vst._releasedEndPointIds[epid]; ok {
+			return fmt.Errorf("endpoint id %d is already released", epid)
+		}
+		vst._releasedEndPointIds[epid] = struct{}{}
+		return nil
+	}
+	return ErrTransportClosed
+}
+
+// endPointIdFor checks an id asked for in NewEndPoint, or allocates one for
+// AnyEndPointId: a fresh one while there are any, then a released one.
+func (vst *ValidTransportState) endPointIdFor(epid EndPointId) (EndPointId, error) {
+	if epid != AnyEndPointId {
+		if epid >= FirstAllocatedEndPointId {
+			return 0, fmt.Errorf("%w: %d", ErrReservedEndPointId, epid)
+		}
+		return epid, nil
+	}
+	if vst._nextEndPointId < AnyEndPointId {
+		epid = vst._nextEndPointId
+		vst._nextEndPointId++
+		return epid, nil
+	}
+	for epid := range vst._releasedEndPointIds {
+		delete(vst._releasedEndPointIds, epid)
+		return epid, nil
+	}
+	return 0, errors.New("out of endpoint ids")
+}
+
 // | Connnect to an endpoint
 func (params *TCPParameters) apiConnect(ourEndPoint *LocalEndPoint, theirAddress EndPointAddress) (*Connection, error) {
 	//TODO: connect to self 756
 
-	err := ourEndPoint.resetIfBroken(theirAddress)
+	key := SocketKey{theirAddress, ourEndPoint.nextStripe(params.tcpStripes)}
+	err := ourEndPoint.resetIfBroken(key)
 	if err != nil {
 		return nil, err
 	}
-	theirEndPoint, connId, err := params.createConnectionTo(ourEndPoint, theirAddress)
+	theirEndPoint, connId, err := params.createConnectionTo(ourEndPoint, key)
 	if err != nil {
 		return nil, err
 	}
@@ -34,20 +83,57 @@ func (params *TCPParameters) apiConnect(ourEndPoint *LocalEndPoint, theirAddress
 	}
 
 	connAlive := NewBool(true)
+	acks := newAcks()
+	theirEndPoint.remoteAcks.add(connId, acks)
 	return &Connection{
 		Close: func() error {
+			theirEndPoint.remoteAcks.remove(connId)
+			acks.fail(ErrConnectionClosed)
 			return ourEndPoint.apiClose(theirEndPoint, connId, connAlive)
 		},
 		Send: func(msg []byte) (int, error) {
-			return ourEndPoint.apiSend(theirEndPoint, connId, msg, connAlive)
+			return ourEndPoint.apiSend(theirEndPoint, connId, msg, connAlive, acks)
+		},
+		SendSync: func(ctx context.Context, msg []byte) error {
+			return ourEndPoint.apiSendSync(ctx, theirEndPoint, connId, msg, connAlive, acks)
+		},
+		Outstanding: func() int {
+			return theirEndPoint.apiOutstanding(connId, connAlive, acks)
+		},
+		SendStream: func(r io.Reader) (int64, error) {
+			return ourEndPoint.apiSendStream(theirEndPoint, connId, r, connAlive)
 		},
 	}, nil
 }
 
-// | Force-close the endpoint
-func (transport *TCPTransport) apiCloseEndPoint(evs []Event, ourEndPoint *LocalEndPoint) error {
-	// Remove the reference from the transport state
-	transport.removeLocalEndPoint(ourEndPoint)
+// nextStripe picks the socket for a new lightweight connection, round robin
+// over the given number of stripes.
+func (ourEndPoint *LocalEndPoint) nextStripe(stripes uint32) uint32 {
+	if stripes <= 1 {
+		return 0
+	}
+	ourState := &ourEndPoint.localState
+	ourState.Lock()
+	defer ourState.Unlock()
+
+	switch st := ourState.value.(type) {
+	case *LocalEndPointValid:
+		vst := &st._1
+		stripe := vst._localNextStripe % stripes
+		vst._localNextStripe++
+		return stripe
+	}
+	return 0
+}
+
+// | Close the endpoint
+//
+// With a positive timeout the close is graceful: everything already queued
+// for a remote endpoint (and the CloseEndPoint message after it) is flushed,
+// and we wait for the peer to close the socket before shutting it down
+// ourselves. Every remote endpoint shares the same deadline. A zero timeout
+// closes all sockets right away.
+func (transport *TCPTransport) apiCloseEndPoint(evs []Event, ourEndPoint *LocalEndPoint, timeout time.Duration) error {
 	// Close the local endpoint
 	ourState := func() *ValidLocalEndPointState {
 		st := &ourEndPoint.localState
@@ -62,8 +148,14 @@ func (transport *TCPTransport) apiCloseEndPoint(evs []Event, ourEndPoint *LocalE
 		return nil
 	}()
 
-	// Close the remote socket and return the set of all incoming connections
-	tryCloseRemoteSocket := func(theirEndPoint *RemoteEndPoint) {
+	deadline, stop := newDeadline(timeout)
+	defer stop()
+
+	// Close the remote socket. The returned function waits (at most until the
+	// deadline) for the socket to drain and close, and must be called without
+	// holding the remote state lock, since the socket reader needs it to
+	// finish.
+	tryCloseRemoteSocket := func(theirEndPoint *RemoteEndPoint) func() {
 		// We make an attempt to close the connection nicely
 		// (by sending a CloseSocket first)
 		closed := &RemoteEndPointFailed{errors.New("apiCloseEndPoint")}
@@ -85,11 +177,10 @@ func (transport *TCPTransport) apiCloseEndPoint(evs []Event, ourEndPoint *LocalE
 			// guaranteed that no other actions will be scheduled after this
 			// one.
 			vst := &st._1
-			vst.sendOn(sendCloseEndPoint)
-			tryShutdownSocketBoth(vst.remoteConn)
-			// remoteSocketClosed(vst)
-
 			theirState.value = closed
+			return func() {
+				vst.drainAndClose(sendCloseEndPoint, theirEndPoint.remoteReaderDone, deadline)
+			}
 		case *RemoteEndPointClosing:
 			resovled := st._1
 			vst := &st._2
@@ -100,17 +191,31 @@ func (transport *TCPTransport) apiCloseEndPoint(evs []Event, ourEndPoint *LocalE
 			// Since we replace the state in this MVar with 'closed', it's
 			// guaranteed that no other actions will be scheduled after this
 			// one.
-			tryShutdownSocketBoth(vst.remoteConn)
-			// remoteSocketClosed(vst)
-
 			theirState.value = closed
+			return func() {
+				vst.drainAndClose(nil, theirEndPoint.remoteReaderDone, deadline)
+			}
 		}
+		return func() {}
 	}
 
 	if ourState != nil {
+		var wg sync.WaitGroup
 		for _, remoteEndPoint := range ourState._localConnections {
-			tryCloseRemoteSocket(remoteEndPoint)
+			waitClosed := tryCloseRemoteSocket(remoteEndPoint)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				waitClosed()
+			}()
 		}
+		wg.Wait()
+	}
+	// Remove the reference from the transport state only now that the
+	// sockets are closed, so that the id is not handed out again while peers
+	// may still be connected to it
+	transport.removeLocalEndPoint(ourEndPoint)
+	if ourState != nil {
 		for _, e := range evs {
 			ourEndPoint.localQueue <- e
 		}
@@ -118,6 +223,60 @@ func (transport *TCPTransport) apiCloseEndPoint(evs []Event, ourEndPoint *LocalE
 	return nil
 }
 
+// newDeadline returns a channel that is closed (so that every waiter sees it)
+// once the timeout expires, and a function to release the timer early.
+func newDeadline(timeout time.Duration) (<-chan struct{}, func()) {
+	deadline := make(chan struct{})
+	if timeout <= 0 {
+		close(deadline)
+		return deadline, func() {}
+	}
+	timer := time.AfterFunc(timeout, func() { close(deadline) })
+	return deadline, func() { timer.Stop() }
+}
+
+// drainAndClose flushes everything queued on the heavyweight connection,
+// followed by last (if any), then waits until the socket reader has seen the
+// peer close the socket. Whatever happens first, the deadline or the close,
+// the socket is shut down afterwards.
+func (vst *ValidRemoteEndPointState) drainAndClose(last Sender, readerDone Notifier, deadline <-chan struct{}) {
+	defer tryShutdownSocketBoth(vst.remoteConn)
+
+	if !vst.drain(last, deadline) {
+		return
+	}
+	select {
+	case <-readerDone:
+	case <-deadline:
+	}
+}
+
+// drain flushes everything queued on the heavyweight connection, followed by
+// last (if any). Returns false if the deadline came first.
+func (vst *ValidRemoteEndPointState) drain(last Sender, deadline <-chan struct{}) bool {
+	select {
+	case <-deadline:
+		return false
+	default:
+	}
+
+	drained := newNotifier()
+	bufWriter := vst.bufWriter
+	vst.sendLast(func(w io.Writer) {
+		if last != nil {
+			last(w)
+		}
+		bufWriter.Flush()
+		notify(drained)
+	})
+	select {
+	case <-drained:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
 //------------------------------------------------------------------------------
 // Incoming requests                                                          --
 //------------------------------------------------------------------------------
@@ -137,11 +296,16 @@ func (tp *TCPTransport) handleConnectionRequest(conn net.Conn) {
 		conn.Close()
 		return
 	}
-	theirAddress, err := decodeEndPointAddress(bs)
+	theirAddress, err := decodeEndPointAddress(bs, tp.transportParams.tcpMaxAddressLength)
 	if err != nil {
 		conn.Close()
 		return
 	}
+	stripe, err := ReadUint32(conn)
+	if err != nil || stripe >= maxStripes {
+		conn.Close()
+		return
+	}
 	fmt.Println("handleConnectionRequest:", theirAddress, "->", ourEndPointID)
 	if !checkPeerHost(conn, theirAddress) {
 		writeConnectionRequestResponse(ConnectionRequestHostMismatch{}, conn)
@@ -178,19 +342,19 @@ func (tp *TCPTransport) handleConnectionRequest(conn net.Conn) {
 		return
 	}
 
-	tp.handleConnectionRequestForEndPoint(ep, theirAddress, conn)
+	tp.handleConnectionRequestForEndPoint(ep, SocketKey{*theirAddress, stripe}, conn)
 }
 
 // endpoint handle incoming connection
-func (tp *TCPTransport) handleConnectionRequestForEndPoint(ourEndPoint *LocalEndPoint, theirAddress *EndPointAddress, conn net.Conn) {
+func (tp *TCPTransport) handleConnectionRequestForEndPoint(ourEndPoint *LocalEndPoint, key SocketKey, conn net.Conn) {
 	// This runs in a thread that will never be killed
-	err := ourEndPoint.resetIfBroken(*theirAddress)
+	err := ourEndPoint.resetIfBroken(key)
 	if err != nil {
 		fmt.Println(err)
 		conn.Close()
 		return
 	}
-	theirEndPoint, isNew, err := ourEndPoint.findRemoteEndPoint(*theirAddress, RequestedByThem{})
+	theirEndPoint, isNew, err := ourEndPoint.findRemoteEndPoint(key, RequestedByThem{})
 	if err != nil {
 		println(err)
 		// writeConnectionRequestResponse(ConnectionRequestCrossed{}, conn)
@@ -206,29 +370,36 @@ func (tp *TCPTransport) handleConnectionRequestForEndPoint(ourEndPoint *LocalEnd
 
 	//handshake!
 	if ourEndPoint.shakeHand != nil {
-		conn, err = ourEndPoint.shakeHand(conn, *theirAddress)
+		conn, err = ourEndPoint.shakeHand(conn, key.address)
 		if err != nil {
 			println("shake hand failed", err)
 			conn.Close()
 			return
 		}
 	}
-	vst := newRemoteEndPointValid(conn)
+	vst := newRemoteEndPointValid(conn, tp.transportParams)
 	writeConnectionRequestResponse(ConnectionRequestAccepted{}, conn)
 	ourEndPoint.resolveInit(theirEndPoint, vst)
 
 	go vst.sendRoutine()
-	tp.transportParams.handleIncomingMessages(ourEndPoint, theirEndPoint)
+	defer conn.Close()
+	tp.transportParams.handleIncomingMessages(ourEndPoint, theirEndPoint, conn)
 }
 
 // | Handle requests from a remote endpoint.
 //
 // Returns only if the remote party closes the socket or if an error occurs.
 // This runs in a thread that will never be killed.
-func (params *TCPParameters) handleIncomingMessages(ourEndPoint *LocalEndPoint, theirEndPoint *RemoteEndPoint) {
+//
+// The socket is passed in rather than taken from the remote state: the local
+// endpoint may already be closing by the time this thread starts, and a
+// graceful close relies on us to read until the peer hangs up.
+func (params *TCPParameters) handleIncomingMessages(ourEndPoint *LocalEndPoint, theirEndPoint *RemoteEndPoint, sock net.Conn) {
 	theirAddress := theirEndPoint.remoteAddress
+	defer notify(theirEndPoint.remoteReaderDone)
 
-	sock, err := func() (net.Conn, error) {
+	// the sending side of the socket, if it is still open
+	vst := func() *ValidRemoteEndPointState {
 		theirState := &theirEndPoint.remoteState
 		theirState.Lock()
 		defer theirState.Unlock()
@@ -239,35 +410,59 @@ func (params *TCPParameters) handleIncomingMessages(ourEndPoint *LocalEndPoint,
 		case *RemoteEndPointInit:
 			ourEndPoint.relyViolation("handleIncomingMessages (init)")
 		case *RemoteEndPointValid:
-			return st._1.remoteConn, nil
+			return &st._1
 		case *RemoteEndPointClosing:
-			return st._2.remoteConn, nil
-		case *RemoteEndPointFailed:
-			return nil, st._1
-		default: //RemoteEndPointClosed
-			return nil, errors.New("handleIncomingMessages (already closed)")
+			return &st._2
 		}
-		return nil, errors.New("handleIncomingMessages (failed)")
+		return nil
 	}()
 
-	if err != nil {
-		ourEndPoint.prematureExit(theirEndPoint, err)
-		return
-	}
-
 	// Read a message and output it on the endPoint's channel. By rights we
 	// should verify that the connection ID is valid, but this is unnecessary
 	// overhead
-	readMessage := func(sock net.Conn, lcid LightweightConnectionId) error {
-		msg, err := ReadWithLen(sock, params.tcpMaxReceiveLength)
+	reader := newFrameReader(sock)
+	growBufferClasses(params.tcpMaxReceiveLength)
+	acks := newIncomingAcks()
+	// reliable sessions carried by our incoming connections, by lightweight
+	// connection
+	sessions := make(map[LightweightConnectionId]*sessionCursor)
+	readMessage := func(lcid LightweightConnectionId) error {
+		msg, err := reader.readPooledWithLen(params.tcpMaxReceiveLength)
 		if err != nil {
 			return err
 		}
-		event := &Received{theirEndPoint.connId(lcid), msg}
-		ourEndPoint.enqueue(event)
+		if cur, ok := sessions[lcid]; ok {
+			n, err := cur.deliver(msg, func(msg []byte) {
+				ourEndPoint.enqueue(newReceived(theirEndPoint.connId(lcid), msg))
+			})
+			if err != nil {
+				return err
+			}
+			acks.delivered(lcid, n)
+			return nil
+		}
+		ourEndPoint.enqueue(newReceived(theirEndPoint.connId(lcid), msg))
+		acks.enqueued(lcid)
 		return nil
 	}
 
+	// Streams being received, by lightweight connection. Only this goroutine
+	// touches the map; whatever is still open when it exits is lost.
+	streams := make(map[LightweightConnectionId]*StreamReader)
+	endStream := func(lcid LightweightConnectionId, err error) {
+		if sr, ok := streams[lcid]; ok {
+			sr.finish(err)
+			delete(streams, lcid)
+		}
+	}
+	defer func() {
+		for lcid := range streams {
+			endStream(lcid, errStreamLost)
+		}
+		theirEndPoint.remoteStreams.fail(errStreamLost)
+		theirEndPoint.remoteAcks.fail(errAcksLost)
+	}()
+
 	// Dispatch
 	//
 	// If a recv throws an exception this will be caught top-level and
@@ -287,20 +482,28 @@ func (params *TCPParameters) handleIncomingMessages(ourEndPoint *LocalEndPoint,
 	}()
 
 	for {
-		lcid, err := ReadUint32(sock)
+		// caught up with the socket, or long enough behind: report what we
+		// have enqueued
+		if !reader.buffered() || acks.due() {
+			acks.flush(theirEndPoint)
+		}
+		lcid, err := reader.readUint32()
 		if err != nil {
 			fmt.Println("read lcid failed", err)
 			panic(err)
 		}
 
 		if uint32(lcid) >= uint32(firstNonReservedLightweightConnectionId) {
-			readMessage(sock, LightweightConnectionId(lcid))
+			if err := readMessage(LightweightConnectionId(lcid)); err != nil {
+				ourEndPoint.prematureExit(theirEndPoint, err)
+				return
+			}
 			continue
 		}
 
 		switch decodeControlHeader(uint8(uint32(lcid))).(type) {
 		case CreateNewConnection:
-			cid, err := ReadUint32(sock)
+			cid, err := reader.readUint32()
 			if err != nil {
 				panic(err)
 			}
@@ -310,23 +513,123 @@ func (params *TCPParameters) handleIncomingMessages(ourEndPoint *LocalEndPoint,
 			}
 			continue
 		case CloseConnection:
-			cid, err := ReadUint32(sock)
+			cid, err := reader.readUint32()
 			if err != nil {
 				panic(err)
 			}
+			// the sender only closes a session's connection to end it
+			if cur, ok := sessions[LightweightConnectionId(cid)]; ok {
+				ourEndPoint.localSessions.remove(cur.key)
+				delete(sessions, LightweightConnectionId(cid))
+			}
 			err = ourEndPoint.onCloseConnection(theirEndPoint, LightweightConnectionId(cid))
 			if err != nil {
 				panic(err)
 			}
+			endStream(LightweightConnectionId(cid), ErrConnectionClosed)
+			acks.closed(LightweightConnectionId(cid))
+			// the last connection in either direction may be gone now
+			ourEndPoint.closeIfUnused(theirEndPoint)
+			continue
+		case StreamData:
+			cid, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			chunk, err := reader.readPooledWithLen(streamChunkSize)
+			if err != nil {
+				panic(err)
+			}
+			lcid := LightweightConnectionId(cid)
+			sr, ok := streams[lcid]
+			if !ok {
+				sr = newStreamReader(func(n uint32) {
+					theirEndPoint.sendStreamCredit(lcid, n)
+				})
+				streams[lcid] = sr
+				ourEndPoint.enqueue(&ReceivedStream{theirEndPoint.connId(lcid), sr})
+			}
+			if len(chunk) == 0 {
+				putBuffer(chunk)
+				endStream(lcid, io.EOF)
+				continue
+			}
+			if err := sr.push(chunk); err != nil {
+				panic(err)
+			}
+			continue
+		case StreamAbort:
+			cid, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			endStream(LightweightConnectionId(cid), errStreamAborted)
+			continue
+		case StreamCredit:
+			cid, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			n, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			theirEndPoint.remoteStreams.grant(LightweightConnectionId(cid), n)
+			continue
+		case AckRequest:
+			cid, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			acks.requested(LightweightConnectionId(cid))
+			continue
+		case Ack:
+			cid, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			n, err := reader.readUint64()
+			if err != nil {
+				panic(err)
+			}
+			theirEndPoint.remoteAcks.ack(LightweightConnectionId(cid), n)
+			continue
+		case SessionOpen:
+			cid, err := reader.readUint32()
+			if err != nil {
+				panic(err)
+			}
+			id, err := reader.readUint64()
+			if err != nil {
+				panic(err)
+			}
+			first, err := reader.readUint64()
+			if err != nil {
+				panic(err)
+			}
+			lcid := LightweightConnectionId(cid)
+			cur := ourEndPoint.localSessions.open(ourEndPoint, theirEndPoint, id, first)
+			sessions[lcid] = cur
+			acks.requested(lcid)
+			acks.delivered(lcid, cur.delivered())
 			continue
 		case CloseSocket:
-			i, err := ReadUint32(sock)
+			i, err := reader.readUint32()
 			if err != nil {
 				panic(err)
 			}
+			// report what we enqueued while the socket is still ours
+			acks.flush(theirEndPoint)
 			didClose := ourEndPoint.onCloseSocket(theirEndPoint, sock, LightweightConnectionId(i))
 			fmt.Println("closing socket...", i, didClose)
 			if didClose {
+				// our own CloseSocket may still be queued; the socket is
+				// closed as soon as we return
+				if vst != nil {
+					deadline, stop := newDeadline(params.tcpCloseTimeout)
+					vst.drain(nil, deadline)
+					stop()
+				}
 				return
 			}
 		case CloseEndPoint:
@@ -347,8 +650,8 @@ func (params *TCPParameters) handleIncomingMessages(ourEndPoint *LocalEndPoint,
 // block until that is resolved.
 //
 // May throw a TransportError ConnectErrorCode exception.
-func (params *TCPParameters) createConnectionTo(ourEndPoint *LocalEndPoint, theirAddress EndPointAddress) (*RemoteEndPoint, LightweightConnectionId, error) {
-	theirEndPoint, err := params.createSocketTo_go(ourEndPoint, theirAddress, nil)
+func (params *TCPParameters) createConnectionTo(ourEndPoint *LocalEndPoint, key SocketKey) (*RemoteEndPoint, LightweightConnectionId, error) {
+	theirEndPoint, err := params.createSocketTo_go(ourEndPoint, key, nil)
 	if err != nil {
 		return nil, firstNonReservedLightweightConnectionId, err
 	}
@@ -356,12 +659,12 @@ func (params *TCPParameters) createConnectionTo(ourEndPoint *LocalEndPoint, thei
 	return theirEndPoint, connId, err
 }
 
-func (params *TCPParameters) createSocketTo(ourEndPoint *LocalEndPoint, theirAddress EndPointAddress) (*RemoteEndPoint, error) {
-	return params.createSocketTo_go(ourEndPoint, theirAddress, nil)
+func (params *TCPParameters) createSocketTo(ourEndPoint *LocalEndPoint, key SocketKey) (*RemoteEndPoint, error) {
+	return params.createSocketTo_go(ourEndPoint, key, nil)
 }
 
-func (params *TCPParameters) createSocketTo_go(ourEndPoint *LocalEndPoint, theirAddress EndPointAddress, rsp ConnectionRequestResponse) (*RemoteEndPoint, error) {
-	theirEndPoint, isNew, err := ourEndPoint.findRemoteEndPoint(theirAddress, RequestedByUs{})
+func (params *TCPParameters) createSocketTo_go(ourEndPoint *LocalEndPoint, key SocketKey, rsp ConnectionRequestResponse) (*RemoteEndPoint, error) {
+	theirEndPoint, isNew, err := ourEndPoint.findRemoteEndPoint(key, RequestedByUs{})
 	switch rsp.(type) {
 	case ConnectionRequestCrossed:
 		func() {
@@ -385,11 +688,11 @@ func (params *TCPParameters) createSocketTo_go(ourEndPoint *LocalEndPoint, their
 
 	if isNew {
 		rsp2, err := ourEndPoint.setupRemoteEndPoint(params, theirEndPoint)
-		fmt.Println("createConnectionTo ", theirAddress, rsp2, err)
+		fmt.Println("createConnectionTo ", key.address, key.stripe, rsp2, err)
 		if err != nil {
 			// return theirEndPoint, firstNonReservedLightweightConnectionId, err
 		}
-		return params.createSocketTo_go(ourEndPoint, theirAddress, rsp2)
+		return params.createSocketTo_go(ourEndPoint, key, rsp2)
 	}
 	return theirEndPoint, nil
 }
@@ -397,7 +700,11 @@ func (params *TCPParameters) createSocketTo_go(ourEndPoint *LocalEndPoint, their
 // | Find a remote endpoint. If the remote endpoint does not yet exist we
 // create it in Init state. Returns if the endpoint was new, or 'Nothing' if
 // it times out.
-func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(theirAddress EndPointAddress, findOrigin RequestedBy) (*RemoteEndPoint, bool, error) {
+//
+// Every stripe of a remote address is a remote endpoint of its own, with its
+// own socket, so crossed connection requests are resolved stripe by stripe.
+func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(key SocketKey, findOrigin RequestedBy) (*RemoteEndPoint, bool, error) {
+	theirAddress := key.address
 	theirEndPoint, isNew, err := func() (*RemoteEndPoint, bool, error) {
 		ourState := &ourEndPoint.localState
 
@@ -407,7 +714,7 @@ func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(theirAddress EndPointAddres
 		switch state := ourState.value.(type) {
 		case *LocalEndPointValid:
 			vst := &state._1
-			if theirEndPoint, ok := vst._localConnections[theirAddress]; ok {
+			if theirEndPoint, ok := vst._localConnections[key]; ok {
 				return theirEndPoint, false, nil
 
 			} else {
@@ -415,13 +722,17 @@ func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(theirAddress EndPointAddres
 				theirState := &RemoteEndPointInit{newNotifier(), newNotifier(), findOrigin}
 				theirEndPoint = &RemoteEndPoint{
 					remoteAddress: theirAddress,
+					remoteStripe:  key.stripe,
 					remoteState: struct {
 						value RemoteState
 						sync.Mutex
 					}{value: theirState},
-					remoteId: vst._nextConnInId,
+					remoteId:         vst._nextConnInId,
+					remoteReaderDone: newNotifier(),
+					remoteStreams:    newStreamWindows(),
+					remoteAcks:       newAckTable(),
 				}
-				vst._localConnections[theirAddress] = theirEndPoint
+				vst._localConnections[key] = theirEndPoint
 				vst._nextConnInId += 1
 				return theirEndPoint, true, nil
 			}
@@ -454,7 +765,7 @@ func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(theirAddress EndPointAddres
 		switch findOrigin.(type) {
 		case RequestedByUs:
 			wait(resolved)
-			return ourEndPoint.findRemoteEndPoint(theirAddress, findOrigin)
+			return ourEndPoint.findRemoteEndPoint(key, findOrigin)
 		case RequestedByThem:
 			switch initOrigin.(type) {
 			case RequestedByUs:
@@ -474,9 +785,9 @@ func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(theirAddress EndPointAddres
 	case *RemoteEndPointClosing:
 		//TODO: wait resolved
 		wait(st._1)
-		return ourEndPoint.findRemoteEndPoint(theirAddress, findOrigin)
+		return ourEndPoint.findRemoteEndPoint(key, findOrigin)
 	case RemoteEndPointClosed:
-		return ourEndPoint.findRemoteEndPoint(theirAddress, findOrigin)
+		return ourEndPoint.findRemoteEndPoint(key, findOrigin)
 	case *RemoteEndPointFailed:
 		return nil, false, st._1
 	}
@@ -493,4 +804,12 @@ func (ourEndPoint *LocalEndPoint) findRemoteEndPoint(theirAddress EndPointAddres
 var defaultTCPParameters = &TCPParameters{
 	tcpMaxAddressLength: 1000,
 	tcpMaxReceiveLength: 4 * 1024 * 1024,
+	tcpFlushMode:        FlushOnIdle{},
+	tcpCloseTimeout:     5 * time.Second,
+	tcpStripes:          1,
+	tcpRetransmitBuffer: 1024,
+	tcpReconnectTimeout: 30 * time.Second,
 }
+
+// Upper bound on the stripe a peer may ask for in a connection request.
+const maxStripes = 64
@@ -0,0 +1,122 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrLocalNodeClosed is the error of using a node after it closed.
+var ErrLocalNodeClosed = errors.New("local node closed")
+
+// Lifecycle tracks the goroutines of a LocalNode: the node controller and
+// the handler of incoming messages. Either stops the other, and the node is
+// done when both have.
+type Lifecycle struct {
+	controllerDone chan struct{}
+	handlerDone    chan struct{}
+	done           chan struct{}
+	endPointClosed sync.Once
+}
+
+func newLifecycle() *Lifecycle {
+	return &Lifecycle{
+		controllerDone: make(chan struct{}),
+		handlerDone:    make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// Close closes every channel of the node and its endpoint, and waits until
+// the node is done. Later calls of NewLocalChannel and SendPayload fail. If
+// ctx is done first, the endpoint is closed abortively and the node finishes
+// stopping after Close returns.
+func (node *LocalNode) Close(ctx context.Context) error {
+	node.closeChannels()
+	life := node.localLife
+	select {
+	case node.localCtrlChan <- NCMsg{node.localEndPoint.Address(), SigShutdown{}}:
+	case <-life.controllerDone:
+	case <-ctx.Done():
+		go node.closeEndPoint(true)
+		return ctx.Err()
+	}
+	select {
+	case <-life.done:
+		return nil
+	case <-ctx.Done():
+		go node.closeEndPoint(true)
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the node has stopped, whether by Close or because its
+// endpoint failed.
+func (node *LocalNode) Done() <-chan struct{} {
+	return node.localLife.done
+}
+
+func (node *LocalNode) controllerExited() {
+	node.closeEndPoint(false)
+	close(node.localLife.controllerDone)
+}
+
+// closeEndPoint closes the endpoint of the node, unless that was done
+// already; abort drops what is still queued. Either way the incoming
+// messages end, and with them the node.
+func (node *LocalNode) closeEndPoint(abort bool) {
+	node.localLife.endPointClosed.Do(func() {
+		if abort {
+			node.localEndPoint.CloseNow()
+		} else {
+			node.localEndPoint.Close()
+		}
+	})
+}
+
+// stopNC stops the node controller, unless it stopped already, once the
+// incoming messages end.
+func (node *LocalNode) stopNC() {
+	life := node.localLife
+	select {
+	case node.localCtrlChan <- NCMsg{node.localEndPoint.Address(), SigShutdown{}}:
+	case <-life.controllerDone:
+	}
+	close(life.handlerDone)
+}
+
+func (node *LocalNode) awaitExit() {
+	life := node.localLife
+	<-life.controllerDone
+	<-life.handlerDone
+	node.closeChannels()
+	node.localMonitors.closeOutboxes()
+	close(life.done)
+}
+
+// toController hands msg to the node controller, unless it has stopped.
+func (node *LocalNode) toController(msg NCMsg) {
+	select {
+	case node.localCtrlChan <- msg:
+	case <-node.localLife.controllerDone:
+	}
+}
+
+// closeChannels marks the node closed and shuts down the channels it had.
+func (node *LocalNode) closeChannels() {
+	var switches map[ChannelID]*LocalChannel
+	var conns OutgoingConnectionMap
+	func() {
+		st := &node.localState
+		st.Lock()
+		defer st.Unlock()
+
+		if vst, ok := st.value.(*LocalNodeValid); ok {
+			switches, conns = vst._1.localSwitches, vst._1.localConnections
+			st.value = LocalNodeClosed{}
+		}
+	}()
+	for chanID, localChannel := range switches {
+		localChannel.shutdown(conns[chanID])
+	}
+}
@@ -0,0 +1,701 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+Membership is SWIM (Das, Gupta, Motivala 2002) over a LocalNode. Every
+protocol period a node pings the next member in a shuffled round robin. If no
+ack arrives within the probe timeout it asks a few other members to ping the
+target for it (pingReq); a target that still has not answered by the end of
+the period becomes suspect, and dead once the suspicion timeout runs out. A
+suspected node that hears about it refutes the suspicion by raising its
+incarnation number.
+
+Membership updates are not sent by themselves but piggybacked on the probe
+traffic, each one a few times log(n), so that they reach everybody in
+O(log n) periods. Every message also carries the sender's own incarnation,
+which is as good as an alive update about it.
+
+Messages travel on the reserved channel membershipChannelID:
+
+	kind u8 | seq u64 | incarnation u64 | target | n u8 | n updates
+
+where target (pingReq only) and the address of an update are a uint16 length
+and an encoded EndPointAddress, and an update is state u8 | incarnation u64 |
+address.
+
+A member that was declared dead while it was only cut off is pinged now and
+then; it learns that it is considered dead, refutes it and rejoins.
+*/
+
+const (
+	msgPing uint8 = iota
+	msgPingReq
+	msgAck
+	msgJoin
+	msgJoinReply
+)
+
+// MemberState is what a node thinks of a member.
+type MemberState uint8
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// MemberEvent reports a member changing state. A node joining shows up as
+// MemberAlive, a node going down as MemberDead.
+type MemberEvent struct {
+	Node  EndPointAddress
+	State MemberState
+}
+
+// Member is a snapshot of a member, see Membership.Members.
+type Member struct {
+	Node        EndPointAddress
+	State       MemberState
+	Incarnation uint64
+}
+
+const (
+	maxPiggyback    = 8  // updates per message
+	gossipMultiple  = 3  // an update is sent gossipMultiple * log2(n) times
+	deadProbePeriod = 10 // protocol periods between pings to a dead member
+	peerQueueLen    = 16 // messages waiting for a peer before more are dropped
+)
+
+var errMembershipClosed = errors.New("membership closed")
+
+// MembershipOption adjusts the timing of a Membership being started.
+type MembershipOption func(*Membership)
+
+// WithProbeInterval sets the protocol period: one member is probed per
+// period.
+func WithProbeInterval(interval time.Duration) MembershipOption {
+	return func(m *Membership) {
+		m.probeInterval = interval
+	}
+}
+
+// WithProbeTimeout sets how long to wait for a direct ack before asking
+// other members to probe.
+func WithProbeTimeout(timeout time.Duration) MembershipOption {
+	return func(m *Membership) {
+		m.probeTimeout = timeout
+	}
+}
+
+// WithIndirectProbes sets how many members are asked to probe a member that
+// did not answer.
+func WithIndirectProbes(n int) MembershipOption {
+	return func(m *Membership) {
+		m.indirectProbes = n
+	}
+}
+
+// WithSuspicionTimeout sets how long a member stays suspect before it is
+// declared dead.
+func WithSuspicionTimeout(timeout time.Duration) MembershipOption {
+	return func(m *Membership) {
+		m.suspicionTimeout = timeout
+	}
+}
+
+// Membership tracks the nodes of a cluster.
+type Membership struct {
+	node    *LocalNode
+	channel *LocalChannel
+	self    EndPointAddress
+
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	indirectProbes   int
+	suspicionTimeout time.Duration
+
+	mtx         sync.Mutex
+	incarnation uint64
+	members     map[EndPointAddress]*member
+	order       []EndPointAddress // probe order of the current round
+	seq         uint64
+	period      uint64
+	probe       *probe
+	relays      map[uint64]relay // pings we send for somebody else's pingReq
+	gossip      []*gossip
+	joined      chan struct{} // closed by the first join reply
+	backlog     []MemberEvent // not yet taken from events
+	senders     map[EndPointAddress]chan []byte
+	// drop, if set, drops all traffic with the peers it returns true for;
+	// tests set it to simulate a network partition.
+	drop func(peer EndPointAddress) bool
+
+	events   chan MemberEvent
+	timeouts chan uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+type member struct {
+	state       MemberState
+	incarnation uint64
+	since       time.Time // of the suspicion
+}
+
+type probe struct {
+	target EndPointAddress
+	seq    uint64
+	acked  bool
+}
+
+type relay struct {
+	origin EndPointAddress
+	seq    uint64 // the origin's
+	period uint64
+}
+
+type update struct {
+	state       MemberState
+	incarnation uint64
+	node        EndPointAddress
+}
+
+type gossip struct {
+	update
+	sent int
+}
+
+// StartMembership starts tracking the cluster of node. Until it joins one
+// with Join (or another node joins through it) it is a cluster of its own.
+func StartMembership(node *LocalNode, opts ...MembershipOption) (*Membership, error) {
+	channel, err := newLocalChannel(node, membershipChannelID, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &Membership{
+		node:             node,
+		channel:          channel,
+		self:             node.localEndPoint.Address(),
+		probeInterval:    time.Second,
+		probeTimeout:     300 * time.Millisecond,
+		indirectProbes:   3,
+		suspicionTimeout: 5 * time.Second,
+		// a restarted node must not be taken for its dead predecessor
+		incarnation: uint64(time.Now().UnixNano()),
+		members:     make(map[EndPointAddress]*member),
+		relays:      make(map[uint64]relay),
+		joined:      make(chan struct{}),
+		senders:     make(map[EndPointAddress]chan []byte),
+		events:      make(chan MemberEvent),
+		timeouts:    make(chan uint64),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	go m.run()
+	return m, nil
+}
+
+// Join joins the cluster of any of the seeds, and returns once one of them
+// has answered.
+func (m *Membership) Join(ctx context.Context, seeds ...EndPointAddress) error {
+	m.mtx.Lock()
+	for _, seed := range seeds {
+		if seed != m.self {
+			m.send(seed, msgJoin, 0, nil, nil)
+		}
+	}
+	joined := m.joined
+	m.mtx.Unlock()
+
+	select {
+	case <-joined:
+		return nil
+	case <-m.done:
+		return errMembershipClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Events delivers every change of a member's state, in order. Events are
+// kept until they are taken.
+func (m *Membership) Events() <-chan MemberEvent {
+	return m.events
+}
+
+// Members returns every member known, dead ones included, but not the local
+// node itself.
+func (m *Membership) Members() []Member {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for addr, mem := range m.members {
+		members = append(members, Member{addr, mem.state, mem.incarnation})
+	}
+	return members
+}
+
+// Close stops taking part in the cluster. The other members will find the
+// node dead.
+func (m *Membership) Close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+	return CloseLocalChannel(m.channel)
+}
+
+func (m *Membership) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		m.mtx.Lock()
+		var out chan MemberEvent
+		var next MemberEvent
+		if len(m.backlog) > 0 {
+			out, next = m.events, m.backlog[0]
+		}
+		m.mtx.Unlock()
+
+		select {
+		case msg, ok := <-m.channel.Queue:
+			if !ok {
+				return
+			}
+			m.mtx.Lock()
+			m.received(msg.From, msg.Payload)
+			m.mtx.Unlock()
+		case <-ticker.C:
+			m.mtx.Lock()
+			m.tick()
+			m.mtx.Unlock()
+		case seq := <-m.timeouts:
+			m.mtx.Lock()
+			m.probeIndirectly(seq)
+			m.mtx.Unlock()
+		case out <- next:
+			m.mtx.Lock()
+			m.backlog = m.backlog[1:]
+			m.mtx.Unlock()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// Failure detection                                                          --
+//------------------------------------------------------------------------------
+
+// tick ends a protocol period and starts the next one. Called with m.mtx
+// held, as is everything below.
+func (m *Membership) tick() {
+	now := time.Now()
+	if p := m.probe; p != nil && !p.acked {
+		if mem, ok := m.members[p.target]; ok && mem.state == MemberAlive {
+			m.set(p.target, MemberSuspect, mem.incarnation)
+		}
+	}
+	m.probe = nil
+	for addr, mem := range m.members {
+		if mem.state == MemberSuspect && now.Sub(mem.since) >= m.suspicionTimeout {
+			m.set(addr, MemberDead, mem.incarnation)
+		}
+	}
+	m.period++
+	for seq, r := range m.relays {
+		if r.period+1 < m.period {
+			delete(m.relays, seq)
+		}
+	}
+
+	if m.period%deadProbePeriod == 0 {
+		if dead := m.pick(1, MemberDead, nil); len(dead) > 0 {
+			m.seq++
+			m.send(dead[0], msgPing, m.seq, nil, nil)
+		}
+	}
+
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+	m.seq++
+	seq := m.seq
+	m.probe = &probe{target: target, seq: seq}
+	m.send(target, msgPing, seq, nil, nil)
+	time.AfterFunc(m.probeTimeout, func() {
+		select {
+		case m.timeouts <- seq:
+		case <-m.stop:
+		}
+	})
+}
+
+// nextTarget walks the live members in random order, one per period.
+func (m *Membership) nextTarget() (EndPointAddress, bool) {
+	for {
+		if len(m.order) == 0 {
+			m.order = m.pick(len(m.members), MemberAlive, nil)
+			if len(m.order) == 0 {
+				return EndPointAddress{}, false
+			}
+		}
+		target := m.order[0]
+		m.order = m.order[1:]
+		if mem, ok := m.members[target]; ok && mem.state != MemberDead {
+			return target, true
+		}
+	}
+}
+
+// probeIndirectly asks other members to ping a target that did not ack in
+// time.
+func (m *Membership) probeIndirectly(seq uint64) {
+	p := m.probe
+	if p == nil || p.seq != seq || p.acked {
+		return
+	}
+	exclude := map[EndPointAddress]bool{p.target: true}
+	for _, helper := range m.pick(m.indirectProbes, MemberAlive, exclude) {
+		target := p.target
+		m.send(helper, msgPingReq, seq, &target, nil)
+	}
+}
+
+// pick returns up to n random members that are alive or suspect, or dead
+// ones if state is MemberDead.
+func (m *Membership) pick(n int, state MemberState, exclude map[EndPointAddress]bool) []EndPointAddress {
+	var candidates []EndPointAddress
+	for addr, mem := range m.members {
+		if exclude[addr] || (mem.state == MemberDead) != (state == MemberDead) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+func (m *Membership) received(from EndPointAddress, payload []byte) {
+	if m.drop != nil && m.drop(from) {
+		return
+	}
+	kind, seq, incarnation, target, updates, err := decodeMembershipMessage(payload)
+	if err != nil {
+		return
+	}
+	m.apply(update{MemberAlive, incarnation, from})
+	for _, u := range updates {
+		m.apply(u)
+	}
+
+	switch kind {
+	case msgPing:
+		m.send(from, msgAck, seq, nil, nil)
+	case msgPingReq:
+		m.seq++
+		m.relays[m.seq] = relay{from, seq, m.period}
+		m.send(*target, msgPing, m.seq, nil, nil)
+	case msgAck:
+		if p := m.probe; p != nil && p.seq == seq {
+			p.acked = true
+		}
+		if r, ok := m.relays[seq]; ok {
+			delete(m.relays, seq)
+			m.send(r.origin, msgAck, r.seq, nil, nil)
+		}
+	case msgJoin:
+		all := make([]update, 0, len(m.members))
+		for addr, mem := range m.members {
+			if mem.state != MemberDead && addr != from {
+				all = append(all, update{mem.state, mem.incarnation, addr})
+			}
+		}
+		m.send(from, msgJoinReply, seq, nil, all)
+	case msgJoinReply:
+		select {
+		case <-m.joined:
+		default:
+			close(m.joined)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// Dissemination                                                              --
+//------------------------------------------------------------------------------
+
+// apply merges what another node says about a member into our view.
+func (m *Membership) apply(u update) {
+	if u.node == m.self {
+		if u.state != MemberAlive && u.incarnation >= m.incarnation {
+			// refute
+			m.incarnation = u.incarnation + 1
+			m.spread(update{MemberAlive, m.incarnation, m.self})
+		}
+		return
+	}
+
+	mem, known := m.members[u.node]
+	switch u.state {
+	case MemberAlive:
+		if known && u.incarnation <= mem.incarnation {
+			return
+		}
+	case MemberSuspect:
+		if !known || mem.state == MemberDead || u.incarnation < mem.incarnation ||
+			(mem.state == MemberSuspect && u.incarnation == mem.incarnation) {
+			return
+		}
+	case MemberDead:
+		if !known || mem.state == MemberDead || u.incarnation < mem.incarnation {
+			return
+		}
+	}
+	m.set(u.node, u.state, u.incarnation)
+}
+
+// set changes our view of a member, reports it and spreads the news.
+func (m *Membership) set(addr EndPointAddress, state MemberState, incarnation uint64) {
+	mem, known := m.members[addr]
+	if !known {
+		mem = &member{}
+		m.members[addr] = mem
+	}
+	changed := !known || mem.state != state
+	mem.state, mem.incarnation = state, incarnation
+	if state == MemberSuspect && changed {
+		mem.since = time.Now()
+	}
+	m.spread(update{state, incarnation, addr})
+	if !changed {
+		return
+	}
+	m.backlog = append(m.backlog, MemberEvent{addr, state})
+	if state == MemberDead {
+		m.node.signal(&Died{addr, DiedNodeDown{}})
+	}
+}
+
+// spread queues an update for piggybacking, replacing older news about the
+// same member.
+func (m *Membership) spread(u update) {
+	for i, g := range m.gossip {
+		if g.node == u.node {
+			m.gossip = append(m.gossip[:i], m.gossip[i+1:]...)
+			break
+		}
+	}
+	m.gossip = append(m.gossip, &gossip{update: u})
+}
+
+// piggyback picks the least sent updates for the next message and retires
+// the ones sent often enough.
+func (m *Membership) piggyback() []update {
+	limit := gossipMultiple * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	var updates []update
+	kept := m.gossip[:0]
+	for _, g := range m.gossip {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, g.update)
+			g.sent++
+		}
+		if g.sent < limit {
+			kept = append(kept, g)
+		}
+	}
+	m.gossip = kept
+	// the updates sent least come first next time
+	for i := 1; i < len(m.gossip); i++ {
+		for j := i; j > 0 && m.gossip[j].sent < m.gossip[j-1].sent; j-- {
+			m.gossip[j], m.gossip[j-1] = m.gossip[j-1], m.gossip[j]
+		}
+	}
+	return updates
+}
+
+// send sends a message with piggybacked updates (or the given ones) without
+// waiting for it. A member we consider dead is told so, which lets it refute.
+func (m *Membership) send(to EndPointAddress, kind uint8, seq uint64, target *EndPointAddress, updates []update) {
+	if m.drop != nil && m.drop(to) {
+		return
+	}
+	if updates == nil {
+		updates = m.piggyback()
+	}
+	if mem, ok := m.members[to]; ok && mem.state == MemberDead {
+		updates = append([]update{{MemberDead, mem.incarnation, to}}, updates...)
+	}
+	payload, err := encodeMembershipMessage(kind, seq, m.incarnation, target, updates)
+	if err != nil {
+		return
+	}
+	queue, ok := m.senders[to]
+	if !ok {
+		queue = make(chan []byte, peerQueueLen)
+		m.senders[to] = queue
+		go m.sendTo(to, queue)
+	}
+	select {
+	case queue <- payload:
+	default:
+		// the peer is slow or unreachable; the protocol copes with lost
+		// messages
+	}
+}
+
+// sendTo sends the messages queued for a peer one by one, so that a peer
+// that takes long to dial holds up no one else.
+func (m *Membership) sendTo(to EndPointAddress, queue chan []byte) {
+	for {
+		select {
+		case payload := <-queue:
+			SendPayload(m.channel, to, payload)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// forgetNode drops our connections to a node that is down or lost, so that
+// they are dialed afresh should it come back.
+func (node *LocalNode) forgetNode(ident Identifier) {
+	addr, ok := ident.(EndPointAddress)
+	if !ok {
+		return
+	}
+	var stale []*Connection
+	func() {
+		st := &node.localState
+		st.Lock()
+		defer st.Unlock()
+
+		if vst, ok := st.value.(*LocalNodeValid); ok {
+			for _, conns := range vst._1.localConnections {
+				if conn, ok := conns[addr]; ok {
+					stale = append(stale, conn)
+					delete(conns, addr)
+				}
+			}
+		}
+	}()
+	for _, conn := range stale {
+		conn.Close()
+	}
+}
+
+//------------------------------------------------------------------------------
+// Wire format                                                                --
+//------------------------------------------------------------------------------
+
+var errInvalidMembershipMessage = errors.New("invalid membership message")
+
+func appendAddress(buf []byte, addr EndPointAddress) ([]byte, error) {
+	bs, err := encodeEndPointAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(bs)))
+	return append(buf, bs...), nil
+}
+
+func readAddress(bs []byte) (EndPointAddress, []byte, error) {
+	if len(bs) < 2 || len(bs) < 2+int(binary.BigEndian.Uint16(bs)) {
+		return EndPointAddress{}, nil, errInvalidMembershipMessage
+	}
+	n := int(binary.BigEndian.Uint16(bs))
+	addr, err := decodeEndPointAddress(bs[2:2+n], uint32(n))
+	if err != nil {
+		return EndPointAddress{}, nil, err
+	}
+	return *addr, bs[2+n:], nil
+}
+
+func encodeMembershipMessage(kind uint8, seq uint64, incarnation uint64, target *EndPointAddress, updates []update) ([]byte, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, kind)
+	buf = binary.BigEndian.AppendUint64(buf, seq)
+	buf = binary.BigEndian.AppendUint64(buf, incarnation)
+	var err error
+	if kind == msgPingReq {
+		if buf, err = appendAddress(buf, *target); err != nil {
+			return nil, err
+		}
+	}
+	if len(updates) > math.MaxUint8 {
+		updates = updates[:math.MaxUint8]
+	}
+	buf = append(buf, uint8(len(updates)))
+	for _, u := range updates {
+		buf = append(buf, uint8(u.state))
+		buf = binary.BigEndian.AppendUint64(buf, u.incarnation)
+		if buf, err = appendAddress(buf, u.node); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func decodeMembershipMessage(bs []byte) (kind uint8, seq uint64, incarnation uint64, target *EndPointAddress, updates []update, err error) {
+	if len(bs) < 17 {
+		return 0, 0, 0, nil, nil, errInvalidMembershipMessage
+	}
+	kind = bs[0]
+	seq = binary.BigEndian.Uint64(bs[1:])
+	incarnation = binary.BigEndian.Uint64(bs[9:])
+	bs = bs[17:]
+	if kind == msgPingReq {
+		var addr EndPointAddress
+		if addr, bs, err = readAddress(bs); err != nil {
+			return
+		}
+		target = &addr
+	}
+	if len(bs) < 1 {
+		return 0, 0, 0, nil, nil, errInvalidMembershipMessage
+	}
+	n := int(bs[0])
+	bs = bs[1:]
+	for i := 0; i < n; i++ {
+		if len(bs) < 9 || bs[0] > uint8(MemberDead) {
+			return 0, 0, 0, nil, nil, errInvalidMembershipMessage
+		}
+		u := update{state: MemberState(bs[0]), incarnation: binary.BigEndian.Uint64(bs[1:])}
+		if u.node, bs, err = readAddress(bs[9:]); err != nil {
+			return
+		}
+		updates = append(updates, u)
+	}
+	return
+}
@@ -0,0 +1,706 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Channels watch each other the way Erlang processes do. A monitor delivers a
+ChannelDown on the watcher's Down channel when the target dies; a link kills
+the watcher instead, unless the target was closed normally, and works both
+ways.
+
+All of it is kept by the node controller. A node that monitors a channel of
+another node tells that node's controller, which remembers which nodes watch
+the channel and sends them a Died signal when it goes. Node controllers talk
+over connections to the reserved channel nodeControllerChannelID:
+
+	monitor    watcher target id link   watcher (of the sender) watches target
+	unmonitor  watcher target id link
+	died       channel reason [msg]     channel (of the sender) died
+	kill       channel msg              close channel with DiedException msg
+	rejected   channel                  channel is closed, or never existed
+	overflow   channel                  see overflow.go
+	opened     id code [msg]            see open.go
+
+Channel ids and the monitor id are uint64, link and reason uint8. The message
+of a DiedException is the rest of the frame.
+
+When the connection to a node is lost every monitor on its channels fires
+with DiedDisconnect, or DiedNodeDown if its endpoint was closed.
+*/
+const (
+	ctrlMonitor uint8 = iota
+	ctrlUnmonitor
+	ctrlDied
+	ctrlKill
+	ctrlRejected
+	ctrlOverflow
+	ctrlOpened
+)
+
+var errInvalidControlMessage = errors.New("invalid node controller message")
+
+// ChannelRef names a channel of any node.
+type ChannelRef struct {
+	Node    EndPointAddress
+	Channel ChannelID
+}
+
+func (ref ChannelRef) tagIdentifier() uint8 {
+	return 1
+}
+
+func (ref ChannelRef) String() string {
+	return fmt.Sprintf("%v/%d", ref.Node, ref.Channel)
+}
+
+// MonitorRef is a monitor or link set up by Monitor or Link.
+type MonitorRef struct {
+	Watcher ChannelRef
+	Target  ChannelRef
+	Id      uint64
+	link    bool
+}
+
+// reverse is the other half of a link, kept by the target's node.
+func (ref MonitorRef) reverse() MonitorRef {
+	return MonitorRef{ref.Target, ref.Watcher, ref.Id, ref.link}
+}
+
+// ChannelDown tells a channel that a channel it monitors has died.
+type ChannelDown struct {
+	Ref    MonitorRef
+	Reason DiedReason
+}
+
+//------------------------------------------------------------------------------
+// API                                                                        --
+//------------------------------------------------------------------------------
+
+// Monitor watches target, which may be on any node. When it dies, whether it
+// is closed, killed, unknown or its node is lost, a ChannelDown arrives on
+// localChannel.Down.
+func Monitor(localChannel *LocalChannel, target ChannelRef) MonitorRef {
+	return localChannel.watch(target, false)
+}
+
+// Link ties localChannel and target together: when either dies for any
+// reason but a normal close, the other is killed. Unmonitor undoes it.
+func Link(localChannel *LocalChannel, target ChannelRef) MonitorRef {
+	return localChannel.watch(target, true)
+}
+
+// Unmonitor removes a monitor or link.
+func Unmonitor(localChannel *LocalChannel, ref MonitorRef) {
+	localChannel.localNode.signal(&SigUnmonitor{ref})
+}
+
+func (localChannel *LocalChannel) watch(target ChannelRef, link bool) MonitorRef {
+	node := localChannel.localNode
+	ref := MonitorRef{
+		Watcher: node.channelRef(localChannel.channelID),
+		Target:  target,
+		Id:      node.localMonitors.nextId.Add(1),
+		link:    link,
+	}
+	node.signal(&SigMonitor{ref})
+	return ref
+}
+
+// Kill closes target, on this node or another. Whatever watches it is told
+// it died of DiedException with the given reason.
+func (node *LocalNode) Kill(target ChannelRef, reason string) error {
+	if target.Node == node.localEndPoint.Address() {
+		node.signal(&Kill{target.Channel, reason})
+		return nil
+	}
+	return node.sendControl(target.Node, encodeKill(target.Channel, reason))
+}
+
+func (node *LocalNode) channelRef(chanID ChannelID) ChannelRef {
+	return ChannelRef{node.localEndPoint.Address(), chanID}
+}
+
+// signal hands sig to the node controller without waiting for it. Signals
+// that do not fit in its channel are handed over later, in order.
+func (node *LocalNode) signal(sig Signal) {
+	msg := NCMsg{node.localEndPoint.Address(), sig}
+	node.localMonitors.signals.push(func() bool {
+		select {
+		case node.localCtrlChan <- msg:
+			return true
+		default:
+			return false
+		}
+	}, func() {
+		node.toController(msg)
+	})
+}
+
+// handoff makes the deliveries that cannot be made at once from a goroutine
+// of its own, in order, so that whoever delivers is not held up.
+type handoff struct {
+	sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// push delivers with try if nothing is queued ahead, and otherwise queues
+// deliver, which may block.
+func (h *handoff) push(try func() bool, deliver func()) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.running {
+		if try() {
+			return
+		}
+		h.running = true
+		go h.run()
+	}
+	h.queue = append(h.queue, deliver)
+}
+
+func (h *handoff) run() {
+	for {
+		h.Lock()
+		if len(h.queue) == 0 {
+			h.running = false
+			h.Unlock()
+			return
+		}
+		deliver := h.queue[0]
+		h.queue[0] = nil
+		h.queue = h.queue[1:]
+		h.Unlock()
+		deliver()
+	}
+}
+
+//------------------------------------------------------------------------------
+// Node controller                                                            --
+//------------------------------------------------------------------------------
+
+// Monitors is the part of the node controller state about monitors and links.
+type Monitors struct {
+	nextId atomic.Uint64
+
+	signals handoff // to the node controller
+
+	sync.Mutex
+	watching map[ChannelRef]map[monitorKey]MonitorRef // ours, by target
+	watchers map[ChannelID]map[EndPointAddress]int    // nodes watching our channels
+	outboxes map[EndPointAddress]*outbox
+	downs    map[ChannelID]*handoff // to the Down channel of a watcher
+}
+
+// monitorKey tells monitors apart: ids are only unique on the node that
+// allocated them, and a target is watched from many nodes.
+type monitorKey struct {
+	watcher ChannelRef
+	id      uint64
+}
+
+func newMonitors() *Monitors {
+	return &Monitors{
+		watching: make(map[ChannelRef]map[monitorKey]MonitorRef),
+		watchers: make(map[ChannelID]map[EndPointAddress]int),
+		outboxes: make(map[EndPointAddress]*outbox),
+		downs:    make(map[ChannelID]*handoff),
+	}
+}
+
+func (node *LocalNode) monitor(ref MonitorRef) {
+	ms := node.localMonitors
+	self := node.localEndPoint.Address()
+
+	if ref.Watcher.Node != self {
+		// another node watches one of our channels
+		if node.getLocalChannel(ref.Target.Channel) == nil {
+			node.post(ref.Watcher.Node, encodeDied(ref.Target.Channel, DiedUnknownId{}))
+			return
+		}
+		ms.addWatcher(ref.Target.Channel, ref.Watcher.Node)
+		if ref.link {
+			ms.watch(ref.reverse())
+		}
+		return
+	}
+
+	ms.watch(ref)
+	if ref.Target.Node != self {
+		if ref.link {
+			ms.addWatcher(ref.Watcher.Channel, ref.Target.Node)
+		}
+		node.post(ref.Target.Node, encodeMonitorRef(ctrlMonitor, ref))
+		return
+	}
+	if node.getLocalChannel(ref.Target.Channel) == nil {
+		ms.unwatch(ref)
+		node.fire([]MonitorRef{ref}, DiedUnknownId{})
+		return
+	}
+	if ref.link {
+		ms.watch(ref.reverse())
+	}
+}
+
+func (node *LocalNode) unmonitor(ref MonitorRef) {
+	ms := node.localMonitors
+	self := node.localEndPoint.Address()
+
+	if ref.Watcher.Node != self {
+		ms.removeWatcher(ref.Target.Channel, ref.Watcher.Node)
+		if ref.link {
+			ms.unwatch(ref.reverse())
+		}
+		return
+	}
+
+	ms.unwatch(ref)
+	if ref.Target.Node != self {
+		if ref.link {
+			ms.removeWatcher(ref.Watcher.Channel, ref.Target.Node)
+		}
+		node.post(ref.Target.Node, encodeMonitorRef(ctrlUnmonitor, ref))
+	} else if ref.link {
+		ms.unwatch(ref.reverse())
+	}
+}
+
+// notifyDied fires the monitors of a channel or a whole node that died.
+func (node *LocalNode) notifyDied(ident Identifier, reason DiedReason) {
+	ms := node.localMonitors
+	self := node.localEndPoint.Address()
+
+	switch id := ident.(type) {
+	case ChannelRef:
+		if id.Node == self {
+			for _, watcher := range ms.takeWatchers(id.Channel) {
+				node.post(watcher, encodeDied(id.Channel, reason))
+			}
+			// the monitors the channel had go with it
+			for _, ref := range ms.takeHeldBy(id) {
+				if ref.Target.Node != self {
+					node.post(ref.Target.Node, encodeMonitorRef(ctrlUnmonitor, ref))
+				}
+			}
+			ms.forgetDowns(id.Channel)
+		}
+		node.fire(ms.take(id), reason)
+	case EndPointAddress:
+		node.fire(ms.takeNode(id), reason)
+		ms.closeOutbox(id)
+	}
+}
+
+func (node *LocalNode) fire(refs []MonitorRef, reason DiedReason) {
+	for _, ref := range refs {
+		if !ref.link {
+			node.deliverDown(ChannelDown{ref, reason})
+			continue
+		}
+		if _, normal := reason.(DiedNormal); !normal {
+			node.killChannel(ref.Watcher.Channel, fmt.Sprintf("linked channel %v died: %v", ref.Target, reason))
+		}
+	}
+}
+
+// deliverDown delivers down to its watcher, in order with the ones before,
+// unless the watcher is closed first.
+func (node *LocalNode) deliverDown(down ChannelDown) {
+	localChannel := node.getLocalChannel(down.Ref.Watcher.Channel)
+	if localChannel == nil {
+		return
+	}
+	node.localMonitors.downsOf(localChannel.channelID).push(func() bool {
+		select {
+		case localChannel.Down <- down:
+			return true
+		default:
+			return false
+		}
+	}, func() {
+		select {
+		case localChannel.Down <- down:
+		case <-localChannel.queueGate.done:
+		}
+	})
+}
+
+func (node *LocalNode) killChannel(chanID ChannelID, reason string) {
+	localChannel := node.getLocalChannel(chanID)
+	conns, err := node.removeLocalChannel(chanID)
+	if err != nil {
+		return
+	}
+	localChannel.shutdown(conns)
+	node.notifyDied(node.channelRef(chanID), &DiedException{reason})
+}
+
+// controlReceived passes a signal from another node controller on to ours.
+func (node *LocalNode) controlReceived(from EndPointAddress, payload []byte) {
+	sig, err := decodeSignal(from, node.localEndPoint.Address(), payload)
+	if err != nil {
+		return
+	}
+	node.toController(NCMsg{from, sig})
+}
+
+// peerLost reports a node we lost the connection to.
+func (node *LocalNode) peerLost(addr EndPointAddress, err error) {
+	var reason DiedReason = DiedDisconnect{}
+	if err == ErrRemoteEndPointClosed {
+		reason = DiedNodeDown{}
+	}
+	// monitors fire before those waiting hear of it
+	node.signal(&Died{addr, reason})
+	node.failOpens(addr, fmt.Errorf("open to %v: %w", addr, err))
+	node.localRPC.failCalls(addr, fmt.Errorf("call to %v: %w", addr, err))
+}
+
+func (ms *Monitors) watch(ref MonitorRef) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	refs, ok := ms.watching[ref.Target]
+	if !ok {
+		refs = make(map[monitorKey]MonitorRef)
+		ms.watching[ref.Target] = refs
+	}
+	refs[monitorKey{ref.Watcher, ref.Id}] = ref
+}
+
+func (ms *Monitors) unwatch(ref MonitorRef) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if refs, ok := ms.watching[ref.Target]; ok {
+		delete(refs, monitorKey{ref.Watcher, ref.Id})
+		if len(refs) == 0 {
+			delete(ms.watching, ref.Target)
+		}
+	}
+}
+
+// take removes and returns the monitors on target.
+func (ms *Monitors) take(target ChannelRef) []MonitorRef {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var taken []MonitorRef
+	for _, ref := range ms.watching[target] {
+		taken = append(taken, ref)
+	}
+	delete(ms.watching, target)
+	return taken
+}
+
+// takeHeldBy removes and returns the monitors watcher has.
+func (ms *Monitors) takeHeldBy(watcher ChannelRef) []MonitorRef {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var taken []MonitorRef
+	for target, refs := range ms.watching {
+		for key, ref := range refs {
+			if ref.Watcher == watcher {
+				taken = append(taken, ref)
+				delete(refs, key)
+			}
+		}
+		if len(refs) == 0 {
+			delete(ms.watching, target)
+		}
+	}
+	return taken
+}
+
+// takeNode removes and returns the monitors on the channels of a node, and
+// forgets that it watches ours.
+func (ms *Monitors) takeNode(node EndPointAddress) []MonitorRef {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var taken []MonitorRef
+	for target, refs := range ms.watching {
+		if target.Node == node {
+			for _, ref := range refs {
+				taken = append(taken, ref)
+			}
+			delete(ms.watching, target)
+		}
+	}
+	for chanID, nodes := range ms.watchers {
+		delete(nodes, node)
+		if len(nodes) == 0 {
+			delete(ms.watchers, chanID)
+		}
+	}
+	return taken
+}
+
+func (ms *Monitors) addWatcher(chanID ChannelID, node EndPointAddress) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	nodes, ok := ms.watchers[chanID]
+	if !ok {
+		nodes = make(map[EndPointAddress]int)
+		ms.watchers[chanID] = nodes
+	}
+	nodes[node]++
+}
+
+func (ms *Monitors) removeWatcher(chanID ChannelID, node EndPointAddress) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	nodes := ms.watchers[chanID]
+	if nodes[node] > 1 {
+		nodes[node]--
+		return
+	}
+	delete(nodes, node)
+	if len(nodes) == 0 {
+		delete(ms.watchers, chanID)
+	}
+}
+
+func (ms *Monitors) downsOf(chanID ChannelID) *handoff {
+	ms.Lock()
+	defer ms.Unlock()
+
+	h, ok := ms.downs[chanID]
+	if !ok {
+		h = &handoff{}
+		ms.downs[chanID] = h
+	}
+	return h
+}
+
+// forgetDowns drops the handoff of a watcher that died; what it still has
+// queued is dropped, as the watcher has shut down.
+func (ms *Monitors) forgetDowns(chanID ChannelID) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	delete(ms.downs, chanID)
+}
+
+func (ms *Monitors) takeWatchers(chanID ChannelID) []EndPointAddress {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var taken []EndPointAddress
+	for node := range ms.watchers[chanID] {
+		taken = append(taken, node)
+	}
+	delete(ms.watchers, chanID)
+	return taken
+}
+
+//------------------------------------------------------------------------------
+// Talking to other node controllers                                          --
+//------------------------------------------------------------------------------
+
+// outbox sends the signals for one node in order, without holding up the
+// node controller while it dials.
+type outbox struct {
+	sync.Mutex
+	queue [][]byte
+	wake  chan struct{}
+	stop  chan struct{}
+}
+
+func (node *LocalNode) post(to EndPointAddress, msg []byte) {
+	ms := node.localMonitors
+	ms.Lock()
+	box, ok := ms.outboxes[to]
+	if !ok {
+		box = &outbox{wake: make(chan struct{}, 1), stop: make(chan struct{})}
+		ms.outboxes[to] = box
+		go node.drain(to, box)
+	}
+	ms.Unlock()
+
+	box.Lock()
+	box.queue = append(box.queue, msg)
+	box.Unlock()
+	select {
+	case box.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (node *LocalNode) drain(to EndPointAddress, box *outbox) {
+	for {
+		select {
+		case <-box.wake:
+		case <-box.stop:
+			return
+		}
+		box.Lock()
+		queue := box.queue
+		box.queue = nil
+		box.Unlock()
+		for _, msg := range queue {
+			// a node we never reached is not reported lost, so the
+			// monitors that could not be set up fire here
+			if err := node.sendControl(to, msg); err != nil && msg[0] == ctrlMonitor {
+				node.signal(&Died{to, DiedDisconnect{}})
+			}
+		}
+	}
+}
+
+func (ms *Monitors) closeOutbox(to EndPointAddress) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if box, ok := ms.outboxes[to]; ok {
+		close(box.stop)
+		delete(ms.outboxes, to)
+	}
+}
+
+func (ms *Monitors) closeOutboxes() {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for to, box := range ms.outboxes {
+		close(box.stop)
+		delete(ms.outboxes, to)
+	}
+}
+
+// sendControl sends msg to the node controller of to, dialing once more if
+// the connection we had is broken.
+func (node *LocalNode) sendControl(to EndPointAddress, msg []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *Connection
+		if conn, err = connBetween(node, nodeControllerChannelID, to); err != nil {
+			return err
+		}
+		if _, err = conn.Send(msg); err == nil {
+			return nil
+		}
+		node.dropLocalConnection(nodeControllerChannelID, to, conn)
+	}
+	return err
+}
+
+func (node *LocalNode) dropLocalConnection(from ChannelID, to EndPointAddress, conn *Connection) {
+	func() {
+		st := &node.localState
+		st.Lock()
+		defer st.Unlock()
+
+		if vst, ok := st.value.(*LocalNodeValid); ok {
+			if conns := vst._1.localConnections[from]; conns[to] == conn {
+				delete(conns, to)
+			}
+		}
+	}()
+	conn.Close()
+}
+
+func encodeMonitorRef(kind uint8, ref MonitorRef) []byte {
+	msg := make([]byte, 26)
+	msg[0] = kind
+	binary.BigEndian.PutUint64(msg[1:], uint64(ref.Watcher.Channel))
+	binary.BigEndian.PutUint64(msg[9:], uint64(ref.Target.Channel))
+	binary.BigEndian.PutUint64(msg[17:], ref.Id)
+	if ref.link {
+		msg[25] = 1
+	}
+	return msg
+}
+
+func encodeDied(chanID ChannelID, reason DiedReason) []byte {
+	msg := make([]byte, 10)
+	msg[0] = ctrlDied
+	binary.BigEndian.PutUint64(msg[1:], uint64(chanID))
+	msg[9] = reason.tagDiedReason()
+	if e, ok := reason.(*DiedException); ok {
+		msg = append(msg, e._1...)
+	}
+	return msg
+}
+
+func encodeRejected(chanID ChannelID) []byte {
+	msg := make([]byte, 9)
+	msg[0] = ctrlRejected
+	binary.BigEndian.PutUint64(msg[1:], uint64(chanID))
+	return msg
+}
+
+func encodeKill(chanID ChannelID, reason string) []byte {
+	msg := make([]byte, 9, 9+len(reason))
+	msg[0] = ctrlKill
+	binary.BigEndian.PutUint64(msg[1:], uint64(chanID))
+	return append(msg, reason...)
+}
+
+// decodeSignal decodes a message that from sent to the node controller of
+// self.
+func decodeSignal(from EndPointAddress, self EndPointAddress, msg []byte) (Signal, error) {
+	if len(msg) < 9 {
+		return nil, errInvalidControlMessage
+	}
+	chanID := ChannelID(binary.BigEndian.Uint64(msg[1:]))
+	switch msg[0] {
+	case ctrlMonitor, ctrlUnmonitor:
+		if len(msg) < 26 {
+			return nil, errInvalidControlMessage
+		}
+		ref := MonitorRef{
+			Watcher: ChannelRef{from, chanID},
+			Target:  ChannelRef{self, ChannelID(binary.BigEndian.Uint64(msg[9:]))},
+			Id:      binary.BigEndian.Uint64(msg[17:]),
+			link:    msg[25] == 1,
+		}
+		if msg[0] == ctrlMonitor {
+			return &SigMonitor{ref}, nil
+		}
+		return &SigUnmonitor{ref}, nil
+	case ctrlDied:
+		if len(msg) < 10 {
+			return nil, errInvalidControlMessage
+		}
+		var reason DiedReason
+		switch msg[9] {
+		case DiedDisconnect{}.tagDiedReason():
+			reason = DiedDisconnect{}
+		case DiedNodeDown{}.tagDiedReason():
+			reason = DiedNodeDown{}
+		case DiedNormal{}.tagDiedReason():
+			reason = DiedNormal{}
+		case DiedUnknownId{}.tagDiedReason():
+			reason = DiedUnknownId{}
+		case (&DiedException{}).tagDiedReason():
+			reason = &DiedException{string(msg[10:])}
+		default:
+			return nil, errInvalidControlMessage
+		}
+		return &Died{ChannelRef{from, chanID}, reason}, nil
+	case ctrlKill:
+		return &Kill{chanID, string(msg[9:])}, nil
+	case ctrlRejected:
+		return &Rejected{chanID}, nil
+	case ctrlOverflow:
+		return &Overflowed{chanID}, nil
+	case ctrlOpened:
+		if len(msg) < 10 {
+			return nil, errInvalidControlMessage
+		}
+		return &Opened{openReply{uint64(chanID), openCode(msg[9]), string(msg[10:])}}, nil
+	}
+	return nil, errInvalidControlMessage
+}
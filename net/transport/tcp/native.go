@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -59,22 +60,125 @@ func (ab *AtomicBool) IsSet() bool {
 	return atomic.LoadInt32((*int32)(ab)) == 1
 }
 
-func encodeEndPointAddress(ep EndPointAddress) []byte {
-	s := ep.String()
-	return []byte(s)
+//-----------------------------------------------------------------------------
+// EndPointAddress wire format                                               --
+//-----------------------------------------------------------------------------
+//
+//	version  uint8   endPointAddressVersion
+//	family   uint8   addressFamilyIPv4 | addressFamilyIPv6 | addressFamilyHost |
+//	                 addressFamilyUnspecified
+//	host     4 bytes (IPv4), 16 bytes (IPv6), uint8 length + name (Host) or
+//	         nothing (Unspecified)
+//	port     uint16
+//	epid     uint32
+//
+// All integers are big endian. The string form "host:port:epid" is only used
+// by EndPointAddress.String().
+
+const endPointAddressVersion uint8 = 1
+
+const (
+	// no host, as in ":9000" for a transport listening on every interface
+	addressFamilyUnspecified uint8 = 0
+	addressFamilyIPv4        uint8 = 4
+	addressFamilyIPv6        uint8 = 6
+	addressFamilyHost        uint8 = 0xff
+)
+
+const maxAddressHostLength = 255
+
+var errInvalidEndPointAddress = errors.New("invalid endpoint address")
+
+// validAddressHost reports whether name can be sent as an addressFamilyHost.
+// A name with ':', '%', brackets or spaces would not survive JoinHostPort and
+// SplitHostPort on the other end; scoped IPv6 addresses such as "fe80::1%eth0"
+// are among them.
+func validAddressHost(name string) bool {
+	return len(name) > 0 && len(name) <= maxAddressHostLength &&
+		!strings.ContainsAny(name, ":%[] ")
 }
 
-func decodeEndPointAddress(bs []byte) (*EndPointAddress, error) {
-	s := string(bs)
-	// fmt.Println("before decode:", s)
-	i := strings.LastIndex(s, ":")
-	addr := TransportAddr(s[:i])
-	epid, err := strconv.Atoi(s[(i + 1):])
+func encodeEndPointAddress(ep EndPointAddress) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(string(ep.TransportAddr))
 	if err != nil {
 		return nil, err
 	}
-	ep := EndPointAddress{addr, EndPointId(uint32(epid))}
-	return &ep, nil
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 2+1+maxAddressHostLength+2+4)
+	buf = append(buf, endPointAddressVersion)
+	if host == "" {
+		buf = append(buf, addressFamilyUnspecified)
+	} else if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			buf = append(buf, addressFamilyIPv4)
+			buf = append(buf, v4...)
+		} else {
+			buf = append(buf, addressFamilyIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if !validAddressHost(host) {
+			return nil, errInvalidEndPointAddress
+		}
+		buf = append(buf, addressFamilyHost, uint8(len(host)))
+		buf = append(buf, host...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(ep.EndPointId))
+	return buf, nil
+}
+
+// decodeEndPointAddress never panics: any truncated, oversized or trailing
+// input is rejected with errInvalidEndPointAddress.
+func decodeEndPointAddress(bs []byte, limit uint32) (*EndPointAddress, error) {
+	if uint64(len(bs)) > uint64(limit) || len(bs) < 2 {
+		return nil, errInvalidEndPointAddress
+	}
+	if bs[0] != endPointAddressVersion {
+		return nil, fmt.Errorf("unsupported endpoint address version %d", bs[0])
+	}
+
+	family, rest := bs[1], bs[2:]
+	var host string
+	switch family {
+	case addressFamilyUnspecified:
+	case addressFamilyIPv4, addressFamilyIPv6:
+		n := net.IPv4len
+		if family == addressFamilyIPv6 {
+			n = net.IPv6len
+		}
+		if len(rest) < n {
+			return nil, errInvalidEndPointAddress
+		}
+		host, rest = net.IP(rest[:n]).String(), rest[n:]
+	case addressFamilyHost:
+		if len(rest) < 1 {
+			return nil, errInvalidEndPointAddress
+		}
+		n := int(rest[0])
+		if n == 0 || len(rest) < 1+n {
+			return nil, errInvalidEndPointAddress
+		}
+		host, rest = string(rest[1:1+n]), rest[1+n:]
+		if !validAddressHost(host) {
+			return nil, errInvalidEndPointAddress
+		}
+	default:
+		return nil, errInvalidEndPointAddress
+	}
+
+	if len(rest) != 2+4 {
+		return nil, errInvalidEndPointAddress
+	}
+	port := binary.BigEndian.Uint16(rest[:2])
+	epid := binary.BigEndian.Uint32(rest[2:])
+
+	addr := TransportAddr(net.JoinHostPort(host, strconv.Itoa(int(port))))
+	return &EndPointAddress{addr, EndPointId(epid)}, nil
 }
 
 func WriteUint32(i uint32, w io.Writer) (int, error) {
@@ -83,6 +187,12 @@ func WriteUint32(i uint32, w io.Writer) (int, error) {
 	return w.Write(buf[:])
 }
 
+func WriteUint64(i uint64, w io.Writer) (int, error) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], i)
+	return w.Write(buf[:])
+}
+
 func WriteWithLen(buf []byte, w io.Writer) (int, error) {
 	WriteUint32(uint32(len(buf)), w)
 	return w.Write(buf[:])
@@ -142,6 +252,69 @@ func ReadWithLen(r io.Reader, limit uint32) ([]byte, error) {
 	return buf, nil
 }
 
+// frameReader is the buffered reader side of a heavyweight connection. Unlike
+// ReadUint32 and ReadWithLen it does not allocate per call: integers are read
+// into a scratch array and payloads come from the buffer pool.
+type frameReader struct {
+	r       *bufio.Reader
+	scratch [8]byte
+}
+
+func newFrameReader(conn net.Conn) *frameReader {
+	return &frameReader{r: bufio.NewReaderSize(conn, minReadBufferSize)}
+}
+
+func (fr *frameReader) readUint32() (uint32, error) {
+	_, err := io.ReadFull(fr.r, fr.scratch[:4])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(fr.scratch[:4]), nil
+}
+
+func (fr *frameReader) readUint64() (uint64, error) {
+	_, err := io.ReadFull(fr.r, fr.scratch[:8])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(fr.scratch[:8]), nil
+}
+
+// buffered reports whether input is already buffered, that is, whether the
+// next read will not block.
+func (fr *frameReader) buffered() bool {
+	return fr.r.Buffered() > 0
+}
+
+// readPooledWithLen reads a length-prefixed payload into a pooled buffer;
+// the caller owns the result and may hand it back with putBuffer.
+func (fr *frameReader) readPooledWithLen(limit uint32) ([]byte, error) {
+	len, err := fr.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if len > limit {
+		return nil, errors.New("limit exceeded")
+	}
+
+	buf := getBuffer(len)
+	_, err = io.ReadFull(fr.r, buf)
+	if err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// newFlushTimer returns the timer the send routine of a heavyweight
+// connection flushes on; only FlushThrottled has one.
+func newFlushTimer(mode FlushMode) *ThrottleTimer {
+	if _, ok := mode.(FlushThrottled); !ok {
+		return nil
+	}
+	return NewThrottleTimer("flush", flushThrottleMS)
+}
+
 func splitHostPort(addr string) (host string, port int) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -177,7 +350,10 @@ func (transport *TCPTransport) forkServer(handler func(net.Conn)) error {
 		return err
 	}
 
-	actualAddr := MkExternalAddress(string(lAddr))
+	// pick up the actual port when listening on port 0
+	host, _, _ := net.SplitHostPort(string(lAddr))
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	actualAddr := MkExternalAddress(net.JoinHostPort(host, port))
 	fmt.Println("transport linsten on :", actualAddr)
 	transport.transportAddr = TransportAddr(actualAddr)
 
@@ -201,7 +377,14 @@ func (transport *TCPTransport) forkServer(handler func(net.Conn)) error {
 // responsible for eventually closing the socket and filling the MVar (which
 // is empty). The MVar must be filled immediately after, and never before,
 // the socket is closed.
-func socketToEndPoint(ourAddress EndPointAddress, theirAddress EndPointAddress, shake ShakeHand) (net.Conn, ConnectionRequestResponse, error) {
+//
+// The connection request is the id of the endpoint we want, our own address
+// (length prefixed) and which of the stripes to that endpoint this socket is.
+func socketToEndPoint(ourAddress EndPointAddress, theirAddress EndPointAddress, stripe uint32, shake ShakeHand) (net.Conn, ConnectionRequestResponse, error) {
+	ourAddressBytes, err := encodeEndPointAddress(ourAddress)
+	if err != nil {
+		return nil, nil, err
+	}
 	sock, err := net.Dial("tcp", string(theirAddress.TransportAddr))
 	if err != nil {
 		return nil, nil, err
@@ -210,7 +393,8 @@ func socketToEndPoint(ourAddress EndPointAddress, theirAddress EndPointAddress,
 	//TODO:1663
 	WriteUint32(uint32(theirAddress.EndPointId), sock)
 	//write our address
-	WriteWithLen(encodeEndPointAddress(ourAddress), sock)
+	WriteWithLen(ourAddressBytes, sock)
+	WriteUint32(stripe, sock)
 	//handshake
 	if shake != nil {
 		sock, err = shake(sock, theirAddress)
@@ -229,7 +413,7 @@ func socketToEndPoint(ourAddress EndPointAddress, theirAddress EndPointAddress,
 
 // for test only
 func socketToEndPoint_(ourAddress EndPointAddress, theirAddress EndPointAddress) (net.Conn, error) {
-	sock, rsp, err := socketToEndPoint(ourAddress, theirAddress, nil)
+	sock, rsp, err := socketToEndPoint(ourAddress, theirAddress, 0, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -276,6 +460,41 @@ func sendCloseEndPoint(w io.Writer) {
 	WriteUint32(uint32(CloseEndPoint{}.tagControlHeader()), w)
 }
 
+func sendStreamData(lcid uint32, chunk []byte, w io.Writer) {
+	WriteUint32(uint32(StreamData{}.tagControlHeader()), w)
+	WriteUint32(lcid, w)
+	WriteWithLen(chunk, w)
+}
+
+func sendStreamAbort(lcid uint32, w io.Writer) {
+	WriteUint32(uint32(StreamAbort{}.tagControlHeader()), w)
+	WriteUint32(lcid, w)
+}
+
+func sendStreamCredit(lcid uint32, n uint32, w io.Writer) {
+	WriteUint32(uint32(StreamCredit{}.tagControlHeader()), w)
+	WriteUint32(lcid, w)
+	WriteUint32(n, w)
+}
+
+func sendAckRequest(lcid uint32, w io.Writer) {
+	WriteUint32(uint32(AckRequest{}.tagControlHeader()), w)
+	WriteUint32(lcid, w)
+}
+
+func sendAck(lcid uint32, n uint64, w io.Writer) {
+	WriteUint32(uint32(Ack{}.tagControlHeader()), w)
+	WriteUint32(lcid, w)
+	WriteUint64(n, w)
+}
+
+func sendSessionOpen(lcid uint32, session uint64, first uint64, w io.Writer) {
+	WriteUint32(uint32(SessionOpen{}.tagControlHeader()), w)
+	WriteUint32(lcid, w)
+	WriteUint64(session, w)
+	WriteUint64(first, w)
+}
+
 func (lcid LightweightConnectionId) sendMsg(msg []byte, w io.Writer) {
 	WriteUint32(uint32(lcid), w)
 	WriteWithLen(msg, w)
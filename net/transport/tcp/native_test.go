@@ -1,10 +1,21 @@
 package tcp
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func SendStr(conn *Connection, msg string) {
@@ -30,6 +41,7 @@ func testAcceptConn(conn net.Conn) {
 	// Initial setup
 	ReadUint32(conn)
 	ReadWithLen(conn, 1000)
+	ReadUint32(conn)
 
 	writeConnectionRequestResponse(ConnectionRequestAccepted{}, conn)
 }
@@ -101,7 +113,7 @@ func mockUnnecessaryConnect(numThreads int, ourAddress EndPointAddress, theirAdd
 
 		go func(idx int) {
 			defer notify(done)
-			sock, rsp, err := socketToEndPoint(ourAddress, theirAddress, nil)
+			sock, rsp, err := socketToEndPoint(ourAddress, theirAddress, 0, nil)
 			fmt.Println("mockUnnecessaryConnect:", idx, rsp, err)
 			if err != nil {
 				return
@@ -165,7 +177,7 @@ func (transport *TCPTransport) internalSocketBetween(ourAddress EndPointAddress,
 		switch st := s.value.(type) {
 		case *LocalEndPointValid:
 			vst := &st._1
-			if ep, ok := vst._localConnections[theirAddress]; ok {
+			if ep, ok := vst._localConnections[SocketKey{theirAddress, 0}]; ok {
 				return ep, nil
 			} else {
 				return nil, errors.New("RemoteEndPoint not found")
@@ -198,3 +210,2125 @@ func (transport *TCPTransport) internalSocketBetween(ourAddress EndPointAddress,
 	}
 	return nil, errors.New("can not happen")
 }
+
+func TestEndPointAddressCodec(t *testing.T) {
+	addrs := []EndPointAddress{
+		NewEndPointAddress("127.0.0.1:9999", 1000),
+		NewEndPointAddress("[::1]:8888", 0),
+		NewEndPointAddress("localhost:80", 4294967295),
+		NewEndPointAddress(":9000", 3),
+	}
+	for _, addr := range addrs {
+		bs, err := encodeEndPointAddress(addr)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		got, err := decodeEndPointAddress(bs, defaultTCPParameters.tcpMaxAddressLength)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		if *got != addr {
+			t.Fatal("want", addr, "got", *got)
+		}
+	}
+
+	if _, err := encodeEndPointAddress(NewEndPointAddress("no-port", 1)); err == nil {
+		t.Fatal("encoded an address without port")
+	}
+	if _, err := encodeEndPointAddress(NewEndPointAddress("[fe80::1%eth0]:80", 1)); err == nil {
+		t.Fatal("encoded a host that cannot be decoded")
+	}
+
+	bs, _ := encodeEndPointAddress(addrs[0])
+	if _, err := decodeEndPointAddress(bs, uint32(len(bs)-1)); err == nil {
+		t.Fatal("decoded an address over the length limit")
+	}
+	for i := 0; i < len(bs); i++ {
+		if _, err := decodeEndPointAddress(bs[:i], 1000); err == nil {
+			t.Fatal("decoded a truncated address", bs[:i])
+		}
+	}
+	if _, err := decodeEndPointAddress(append(bs, 0), 1000); err == nil {
+		t.Fatal("decoded an address with trailing bytes")
+	}
+	if _, err := decodeEndPointAddress([]byte("127.0.0.1"), 1000); err == nil {
+		t.Fatal("decoded a text address")
+	}
+}
+
+func TestDialFromUnspecifiedHost(t *testing.T) {
+	serverTp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverTp.Close()
+	clientTp, err := CreateTransport(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientTp.Close()
+	server, err := serverTp.NewEndPoint(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := clientTp.NewEndPoint(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := client.Dial(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Send([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if e, ok := server.Receive().(*Received); ok {
+			if string(e._2) != "hi" {
+				t.Fatal(string(e._2))
+			}
+			return
+		}
+	}
+}
+
+func FuzzDecodeEndPointAddress(f *testing.F) {
+	for _, addr := range []string{"127.0.0.1:9999", "[::1]:1", "example.org:80"} {
+		bs, _ := encodeEndPointAddress(NewEndPointAddress(addr, 7))
+		f.Add(bs)
+	}
+	f.Add([]byte("127.0.0.1:9999:7"))
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		addr, err := decodeEndPointAddress(bs, defaultTCPParameters.tcpMaxAddressLength)
+		if err != nil {
+			return
+		}
+		again, err := encodeEndPointAddress(*addr)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		if _, err := decodeEndPointAddress(again, defaultTCPParameters.tcpMaxAddressLength); err != nil {
+			t.Fatal(addr, err)
+		}
+	})
+}
+
+// loopReader serves the same frame over and over without touching the network
+type loopReader struct {
+	frame []byte
+	off   int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.frame[r.off:])
+	r.off = (r.off + n) % len(r.frame)
+	return n, nil
+}
+
+func newLoopFrame(size int) *loopReader {
+	var buf bytes.Buffer
+	WriteUint32(uint32(firstNonReservedLightweightConnectionId), &buf)
+	WriteWithLen(make([]byte, size), &buf)
+	return &loopReader{frame: buf.Bytes()}
+}
+
+func benchmarkReadWithLen(b *testing.B, size int) {
+	r := bufio.NewReader(newLoopFrame(size))
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		ReadUint32(r)
+		msg, _ := ReadWithLen(r, defaultTCPParameters.tcpMaxReceiveLength)
+		event := &Received{ConnectionId(i), msg}
+		_ = event
+	}
+}
+
+func benchmarkFrameReader(b *testing.B, size int) {
+	fr := &frameReader{r: bufio.NewReader(newLoopFrame(size))}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		fr.readUint32()
+		msg, _ := fr.readPooledWithLen(defaultTCPParameters.tcpMaxReceiveLength)
+		newReceived(ConnectionId(i), msg).Release()
+	}
+}
+
+func BenchmarkReadWithLen64(b *testing.B) { benchmarkReadWithLen(b, 64) }
+func BenchmarkReadWithLen4K(b *testing.B) { benchmarkReadWithLen(b, 4096) }
+func BenchmarkReadWithLen1M(b *testing.B) { benchmarkReadWithLen(b, 1<<20) }
+func BenchmarkFrameReader64(b *testing.B) { benchmarkFrameReader(b, 64) }
+func BenchmarkFrameReader4K(b *testing.B) { benchmarkFrameReader(b, 4096) }
+func BenchmarkFrameReader1M(b *testing.B) { benchmarkFrameReader(b, 1<<20) }
+
+func TestBufferPool(t *testing.T) {
+	limit := defaultTCPParameters.tcpMaxReceiveLength
+	for _, n := range []uint32{0, 1, 64, 65, 4096, limit} {
+		buf := getBuffer(n)
+		if uint32(len(buf)) != n {
+			t.Fatal("want length", n, "got", len(buf))
+		}
+		putBuffer(buf)
+	}
+	if buf := getBuffer(maxPooledBufferSize + 1); len(buf) != maxPooledBufferSize+1 {
+		t.Fatal("oversized buffer has wrong length", len(buf))
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		putBuffer(getBuffer(1000))
+		putBuffer(getBuffer(0))
+	})
+	if allocs != 0 {
+		t.Fatal("pooled buffers allocate", allocs)
+	}
+
+	// a transport with a larger limit gets its payloads pooled too
+	growBufferClasses(2 * limit)
+	if buf := getBuffer(2 * limit); cap(buf) != int(2*limit) {
+		t.Fatal("payload at the raised limit is not pooled, capacity", cap(buf))
+	}
+
+	var held [][]byte
+	for i := 0; i < 2*bufferPoolBudget/int(limit); i++ {
+		held = append(held, getBuffer(limit))
+	}
+	for _, buf := range held {
+		putBuffer(buf)
+	}
+	if n := bufferPoolIdle.Load(); n > bufferPoolBudget {
+		t.Fatal("pool keeps", n, "idle bytes")
+	}
+}
+
+func TestReceivedReleaseTwice(t *testing.T) {
+	event := newReceived(1, getBuffer(100))
+	event.Release()
+	event.Release()
+	a, b := newReceived(2, getBuffer(100)), newReceived(3, getBuffer(100))
+	if a == b || &a._2[0] == &b._2[0] {
+		t.Fatal("the pool handed out one event twice")
+	}
+}
+
+// benchPair connects a client endpoint to an echo endpoint on loopback
+func benchPair(b *testing.B, opts ...TransportOption) (*EndPoint, *Connection) {
+	serverTp, err := CreateTransport("127.0.0.1:0", opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	clientTp, err := CreateTransport("127.0.0.1:0", opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := serverTp.NewEndPoint(1000, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := clientTp.NewEndPoint(2000, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	go func() {
+		var reply *Connection
+		for {
+			switch e := server.Receive().(type) {
+			case *ConnectionOpened:
+				if reply == nil {
+					reply, _ = server.Dial(e._2)
+				}
+			case *Received:
+				reply.Send(e._2)
+			case EndPointClosed:
+				return
+			}
+		}
+	}()
+
+	conn, err := client.Dial(server.Address())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return client, conn
+}
+
+func receivePayload(ep *EndPoint) []byte {
+	for {
+		if e, ok := ep.Receive().(*Received); ok {
+			return e._2
+		}
+	}
+}
+
+func benchmarkLatency(b *testing.B, opts ...TransportOption) {
+	client, conn := benchPair(b, opts...)
+	msg := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Send(msg)
+		receivePayload(client)
+	}
+}
+
+func benchmarkThroughput(b *testing.B, opts ...TransportOption) {
+	client, conn := benchPair(b, opts...)
+	msg := make([]byte, 1024)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			conn.Send(msg)
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		receivePayload(client)
+	}
+}
+
+func BenchmarkLatencyFlushOnIdle(b *testing.B)    { benchmarkLatency(b) }
+func BenchmarkLatencyFlushThrottled(b *testing.B) { benchmarkLatency(b, WithThrottledFlush()) }
+func BenchmarkThroughputFlushOnIdle(b *testing.B) { benchmarkThroughput(b) }
+func BenchmarkThroughputFlushThrottled(b *testing.B) {
+	benchmarkThroughput(b, WithThrottledFlush())
+}
+
+func TestGracefulCloseEndPoint(t *testing.T) {
+	serverTp, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := *defaultTCPParameters
+	WithThrottledFlush()(&params)
+	clientTp, err := createTCPTransport("127.0.0.1:0", &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := serverTp.apiNewEndPoint(1000, nil)
+	client, _ := clientTp.apiNewEndPoint(2000, nil)
+
+	conn, err := client.Dial(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hold the send routine, so that everything is still queued when the
+	// close begins
+	theirEndPoint := remoteEndPoint(clientTp, 2000, server.Address())
+	hold := make(chan struct{})
+	theirEndPoint.remoteState.Lock()
+	theirEndPoint.remoteState.value.(*RemoteEndPointValid)._1.sendQueue.PushExpress(func(io.Writer) {
+		<-hold
+	})
+	theirEndPoint.remoteState.Unlock()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		conn.Send([]byte("result"))
+	}
+	start := time.Now()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Close()
+	}()
+	for {
+		theirEndPoint.remoteState.Lock()
+		_, valid := theirEndPoint.remoteState.value.(*RemoteEndPointValid)
+		theirEndPoint.remoteState.Unlock()
+		if !valid {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(hold)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > defaultTCPParameters.tcpCloseTimeout {
+		t.Fatal("graceful close took", elapsed)
+	}
+
+	received := 0
+	for {
+		switch e := server.Receive().(type) {
+		case *Received:
+			received++
+		case *ConnectionClosed:
+			if received != n {
+				t.Fatal("want", n, "messages before ConnectionClosed, got", received)
+			}
+			return
+		case *ErrorEvent:
+			t.Fatal("unexpected", e, e._2)
+		}
+	}
+}
+
+// remoteEndPoint returns the remote endpoint at addr of the endpoint epid of
+// tp.
+func remoteEndPoint(tp *TCPTransport, epid EndPointId, addr EndPointAddress) *RemoteEndPoint {
+	tp.transportState.Lock()
+	ep := tp.transportState.value.(*TransPortValid)._1._localEndPoints[epid]
+	tp.transportState.Unlock()
+
+	ep.localState.Lock()
+	defer ep.localState.Unlock()
+	for key, theirEndPoint := range ep.localState.value.(*LocalEndPointValid)._1._localConnections {
+		if key.address == addr {
+			return theirEndPoint
+		}
+	}
+	return nil
+}
+
+func streamPair(t *testing.T) (server, client *EndPoint) {
+	serverTp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ = serverTp.NewEndPoint(1000, nil)
+	client, _ = clientTp.NewEndPoint(2000, nil)
+	return server, client
+}
+
+func receiveStream(t *testing.T, ep *EndPoint) *StreamReader {
+	for {
+		switch e := ep.Receive().(type) {
+		case *ReceivedStream:
+			return e.Stream()
+		case *ErrorEvent:
+			t.Fatal("unexpected", e, e._2)
+		}
+	}
+}
+
+func TestSendStream(t *testing.T) {
+	server, client := streamPair(t)
+	streamConn, err := client.Dial(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgConn, err := client.Dial(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// well beyond tcpMaxReceiveLength
+	payload := make([]byte, 5*defaultTCPParameters.tcpMaxReceiveLength+123)
+	rand.New(rand.NewSource(1)).Read(payload)
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := streamConn.SendStream(bytes.NewReader(payload))
+		done <- result{n, err}
+	}()
+
+	// Nobody reads the stream yet, so its sender is stuck on credit. Other
+	// connections must keep flowing meanwhile.
+	stream := receiveStream(t, server)
+	const n = 100
+	for i := 0; i < n; i++ {
+		msgConn.Send([]byte("ping"))
+	}
+	for received := 0; received < n; {
+		if _, ok := server.Receive().(*Received); ok {
+			received++
+		}
+	}
+	select {
+	case r := <-done:
+		t.Fatal("stream finished before it was read", r.n, r.err)
+	default:
+	}
+
+	got, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("stream corrupted, got", len(got), "bytes, want", len(payload))
+	}
+	if r := <-done; r.err != nil || r.n != int64(len(payload)) {
+		t.Fatal("SendStream", r.n, r.err)
+	}
+}
+
+func TestSendStreamAbort(t *testing.T) {
+	server, client := streamPair(t)
+	conn, err := client.Dial(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("disk on fire")
+	done := make(chan error, 1)
+	go func() {
+		r := io.MultiReader(bytes.NewReader(make([]byte, 3*streamChunkSize/2)), iotest.ErrReader(failure))
+		_, err := conn.SendStream(r)
+		done <- err
+	}()
+
+	stream := receiveStream(t, server)
+	if _, err := ioutil.ReadAll(stream); err != errStreamAborted {
+		t.Fatal("want", errStreamAborted, "got", err)
+	}
+	if err := <-done; err != failure {
+		t.Fatal("want", failure, "got", err)
+	}
+
+	// the connection is still usable for the next stream
+	go func() {
+		_, err := conn.SendStream(bytes.NewReader([]byte("again")))
+		done <- err
+	}()
+	stream = receiveStream(t, server)
+	if got, err := ioutil.ReadAll(stream); err != nil || string(got) != "again" {
+		t.Fatal("second stream", string(got), err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendScheduler(t *testing.T) {
+	s := NewSendScheduler(100)
+	var order []string
+	msg := func(name string) Sender {
+		return func(io.Writer) { order = append(order, name) }
+	}
+
+	// connection 2000 queues two 4MB messages before 2001 gets a word in
+	s.PushPayload(2000, 4<<20, msg("big1"))
+	s.PushPayload(2000, 4<<20, msg("big2"))
+	for i := 0; i < 3; i++ {
+		s.PushPayload(2001, 100, msg(fmt.Sprint("small", i)))
+	}
+	s.PushControl(2001, msg("close2001"))
+	s.PushControl(2002, msg("close2002"))
+	s.PushExpress(msg("create2003"))
+	s.PushLast(msg("closeEndPoint"))
+	s.PushExpress(msg("create2004"))
+
+	if n := s.RunQueued(ioutil.Discard); n != 10 {
+		t.Fatal("ran", n, "messages, want 10")
+	}
+	want := []string{
+		// control messages that do not wait for payloads go first
+		"close2002", "create2003",
+		// 2000 has to save up for its big messages while 2001 drains
+		"small0", "small1", "small2", "close2001",
+		"big1", "big2",
+		// and nothing overtakes the last message
+		"closeEndPoint", "create2004",
+	}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatal("got", order, "want", want)
+	}
+	if s.TryNext() != nil || s.Len() != 0 {
+		t.Fatal("scheduler not empty")
+	}
+
+	// CloseSocket goes first, unless payloads are still queued
+	order = nil
+	s.PushClose(msg("closeSocket1"))
+	s.PushPayload(2005, 100, msg("small2005"))
+	s.PushClose(msg("closeSocket2"))
+	s.PushExpress(msg("credit2005"))
+	s.RunQueued(ioutil.Discard)
+	want = []string{"closeSocket1", "small2005", "closeSocket2", "credit2005"}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatal("got", order, "want", want)
+	}
+}
+
+// localSockets counts the remote endpoints (sockets) ep keeps to addr.
+func localSockets(tp *TCPTransport, epid EndPointId, addr EndPointAddress) int {
+	tp.transportState.Lock()
+	ep := tp.transportState.value.(*TransPortValid)._1._localEndPoints[epid]
+	tp.transportState.Unlock()
+
+	ep.localState.Lock()
+	defer ep.localState.Unlock()
+	n := 0
+	if st, ok := ep.localState.value.(*LocalEndPointValid); ok {
+		for key := range st._1._localConnections {
+			if key.address == addr {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestStripes(t *testing.T) {
+	const stripes, conns, msgs = 4, 8, 50
+	params := *defaultTCPParameters
+	WithStripes(stripes)(&params)
+	serverTp, err := createTCPTransport("127.0.0.1:0", &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTp, err := createTCPTransport("127.0.0.1:0", &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := serverTp.apiNewEndPoint(1000, nil)
+	client, _ := clientTp.apiNewEndPoint(2000, nil)
+
+	// both sides dial at once, so some stripes cross
+	var dialed [2][]*Connection
+	done := make(chan error, 2)
+	for i, pair := range [][2]*EndPoint{{client, server}, {server, client}} {
+		go func(i int, from, to *EndPoint) {
+			for c := 0; c < conns; c++ {
+				conn, err := from.Dial(to.Address())
+				if err != nil {
+					done <- err
+					return
+				}
+				dialed[i] = append(dialed[i], conn)
+			}
+			done <- nil
+		}(i, pair[0], pair[1])
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := localSockets(clientTp, 2000, server.Address()); n != stripes {
+		t.Fatal("client has", n, "sockets to the server, want", stripes)
+	}
+
+	for c, conn := range dialed[0] {
+		for m := 0; m < msgs; m++ {
+			conn.Send([]byte(fmt.Sprint(c, " ", m)))
+		}
+	}
+	next := make(map[ConnectionId]int)
+	opened := 0
+	for received := 0; received < conns*msgs; {
+		switch e := server.Receive().(type) {
+		case *ConnectionOpened:
+			opened++
+		case *Received:
+			var c, m int
+			fmt.Sscan(string(e._2), &c, &m)
+			if m != next[e._1] {
+				t.Fatal("connection", c, "got message", m, "want", next[e._1])
+			}
+			next[e._1]++
+			received++
+		case *ErrorEvent:
+			t.Fatal("unexpected", e, e._2)
+		}
+	}
+	if opened != conns || len(next) != conns {
+		t.Fatal("server saw", opened, "connections opened and", len(next), "sending, want", conns)
+	}
+
+	// once every lightweight connection is closed, so is every socket
+	for _, conns := range dialed {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for localSockets(clientTp, 2000, server.Address()) > 0 || localSockets(serverTp, 1000, client.Address()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sockets still open:", localSockets(clientTp, 2000, server.Address()),
+				localSockets(serverTp, 1000, client.Address()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// queuedEvents counts the events waiting on the receive queue of an endpoint.
+func queuedEvents(tp *TCPTransport, epid EndPointId) int {
+	tp.transportState.Lock()
+	defer tp.transportState.Unlock()
+	return len(tp.transportState.value.(*TransPortValid)._1._localEndPoints[epid].localQueue)
+}
+
+func TestSendSync(t *testing.T) {
+	serverTp, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTp, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := serverTp.apiNewEndPoint(1000, nil)
+	client, _ := clientTp.apiNewEndPoint(2000, nil)
+	conn, err := client.Dial(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ConnectionOpened, 9 messages and the one sent synchronously
+	for i := 0; i < 9; i++ {
+		conn.Send([]byte("hello"))
+	}
+	if err := conn.SendSync(context.Background(), []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if n := queuedEvents(serverTp, 1000); n != 11 {
+		t.Fatal("server has", n, "events queued, want 11")
+	}
+	if n := conn.Outstanding(); n != 0 {
+		t.Fatal(n, "messages outstanding after SendSync")
+	}
+
+	// the server does not read, so once its queue is full nothing is
+	// acknowledged anymore
+	for i := 0; i < defaultEndPointQueueCapacity; i++ {
+		conn.Send([]byte("hello"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := conn.SendSync(ctx, []byte("world")); err != context.DeadlineExceeded {
+		t.Fatal("SendSync to a full queue:", err)
+	}
+	if n := conn.Outstanding(); n == 0 {
+		t.Fatal("nothing outstanding while the server is not reading")
+	}
+
+	for i := 0; i < defaultEndPointQueueCapacity+12; i++ {
+		server.Receive()
+	}
+	for deadline := time.Now().Add(5 * time.Second); conn.Outstanding() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal(conn.Outstanding(), "messages still outstanding")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn.Close()
+	if err := conn.SendSync(context.Background(), []byte("late")); err != ErrConnectionClosed {
+		t.Fatal("SendSync on a closed connection:", err)
+	}
+}
+
+// breakSockets shuts down the sockets ep keeps to addr, the way a network
+// failure would.
+func breakSockets(tp *TCPTransport, epid EndPointId, addr EndPointAddress) {
+	tp.transportState.Lock()
+	ep := tp.transportState.value.(*TransPortValid)._1._localEndPoints[epid]
+	tp.transportState.Unlock()
+
+	ep.localState.Lock()
+	defer ep.localState.Unlock()
+	for key, theirEndPoint := range ep.localState.value.(*LocalEndPointValid)._1._localConnections {
+		if key.address != addr {
+			continue
+		}
+		theirEndPoint.remoteState.Lock()
+		if st, ok := theirEndPoint.remoteState.value.(*RemoteEndPointValid); ok {
+			tryShutdownSocketBoth(st._1.remoteConn)
+		}
+		theirEndPoint.remoteState.Unlock()
+	}
+}
+
+func TestReliableResend(t *testing.T) {
+	const msgs = 2000
+	serverTp, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// throttled, so that a good part of what we send is still buffered when
+	// the socket breaks
+	params := *defaultTCPParameters
+	WithThrottledFlush()(&params)
+	clientTp, err := createTCPTransport("127.0.0.1:0", &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := serverTp.apiNewEndPoint(1000, nil)
+	client, _ := clientTp.apiNewEndPoint(2000, nil)
+	conn, err := client.DialReliable(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < msgs; i++ {
+		if _, err := conn.Send([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == msgs/2 {
+			breakSockets(clientTp, 2000, server.Address())
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := conn.SendSync(ctx, []byte(fmt.Sprint(msgs))); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.Outstanding(); n != 0 {
+		t.Fatal(n, "messages outstanding after SendSync")
+	}
+
+	lost := 0
+	for next := 0; next <= msgs; {
+		switch e := server.Receive().(type) {
+		case *ErrorEvent:
+			lost++
+		case *Received:
+			var i int
+			fmt.Sscan(string(e._2), &i)
+			if i != next {
+				t.Fatal("got message", i, "want", next)
+			}
+			next++
+		}
+	}
+	if lost == 0 {
+		t.Fatal("the socket did not break")
+	}
+
+	conn.Close()
+	for {
+		if _, ok := server.Receive().(*ConnectionClosed); ok {
+			break
+		}
+	}
+	sessions := serverTp.transportState.value.(*TransPortValid)._1._localEndPoints[1000].localSessions
+	sessions.Lock()
+	defer sessions.Unlock()
+	if n := len(sessions.sessions); n != 0 {
+		t.Fatal(n, "sessions left after Close")
+	}
+}
+
+func TestSessionCursor(t *testing.T) {
+	sessions := newInboundSessions()
+	old := &RemoteEndPoint{remoteAddress: NewEndPointAddress("127.0.0.1:1", 1)}
+	resumed := &RemoteEndPoint{remoteAddress: old.remoteAddress}
+	var got []string
+	enqueue := func(msg []byte) { got = append(got, string(msg)) }
+
+	cur := sessions.open(nil, old, 7, 1)
+	for _, msg := range []string{"a", "b", "c"} {
+		if _, err := cur.deliver([]byte(msg), enqueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// resent from the last acknowledged message: what arrived is dropped
+	cur = sessions.open(nil, resumed, 7, 2)
+	for _, msg := range []string{"b", "c", "d"} {
+		if _, err := cur.deliver([]byte(msg), enqueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(got) != "[a b c d]" {
+		t.Fatal("delivered", got)
+	}
+	// a connection that would skip messages fails
+	cur = sessions.open(nil, resumed, 7, 6)
+	if n, err := cur.deliver([]byte("f"), enqueue); err != errSessionGap || n != 4 {
+		t.Fatal("want a gap after 4, got", n, err)
+	}
+}
+
+func TestAllocateEndPointId(t *testing.T) {
+	tp, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := tp.ToTransport()
+
+	a, err := transport.NewEndPoint(AnyEndPointId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := transport.NewEndPoint(AnyEndPointId, nil)
+	if a.Address().EndPointId != FirstAllocatedEndPointId || b.Address().EndPointId != FirstAllocatedEndPointId+1 {
+		t.Fatal("allocated", a.Address(), b.Address())
+	}
+	if _, err := transport.NewEndPoint(FirstAllocatedEndPointId+5, nil); !errors.Is(err, ErrReservedEndPointId) {
+		t.Fatal("asked for an id in the allocated range")
+	}
+	if _, err := transport.NewEndPoint(1000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	aid := a.Address().EndPointId
+	if err := transport.ReleaseEndPointId(aid); err == nil {
+		t.Fatal("released the id of an open endpoint")
+	}
+	a.Close()
+	if err := transport.ReleaseEndPointId(aid); err != nil {
+		t.Fatal(err)
+	}
+	for _, epid := range []EndPointId{aid, 1000, FirstAllocatedEndPointId + 2} {
+		if err := transport.ReleaseEndPointId(epid); err == nil {
+			t.Fatal("released", epid)
+		}
+	}
+
+	// released ids come back only once the fresh ones are used up
+	c, _ := transport.NewEndPoint(AnyEndPointId, nil)
+	if c.Address().EndPointId != FirstAllocatedEndPointId+2 {
+		t.Fatal("allocated", c.Address(), "before running out")
+	}
+	tp.transportState.Lock()
+	tp.transportState.value.(*TransPortValid)._1._nextEndPointId = AnyEndPointId
+	tp.transportState.Unlock()
+	if d, err := transport.NewEndPoint(AnyEndPointId, nil); err != nil || d.Address().EndPointId != aid {
+		t.Fatal("after running out:", d, err)
+	}
+	if _, err := transport.NewEndPoint(AnyEndPointId, nil); err == nil {
+		t.Fatal("allocated an id with none left")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	serverTp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, _ := serverTp.NewEndPoint(AnyEndPointId, nil)
+	other, _ := clientTp.NewEndPoint(AnyEndPointId, nil)
+	if err := serverTp.Register("echo", echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverTp.Register("echo", echo); err == nil {
+		t.Fatal("registered a name twice")
+	}
+	if err := serverTp.Register("other", other); err == nil {
+		t.Fatal("registered an endpoint of another transport")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	serverAddr := TransportAddr(serverTp.Address())
+	for _, tp := range []*Transport{clientTp, serverTp} {
+		addr, err := tp.Lookup(ctx, serverAddr, "echo")
+		if err != nil || addr != echo.Address() {
+			t.Fatal("lookup:", addr, err)
+		}
+	}
+	notFound := func(name string) {
+		var ce *ConnectError
+		_, err := clientTp.Lookup(ctx, serverAddr, name)
+		if !errors.As(err, &ce) {
+			t.Fatal("lookup of", name, ":", err)
+		}
+		if _, ok := ce.Code.(ConnectNotFound); !ok {
+			t.Fatal("lookup of", name, ":", err)
+		}
+	}
+	notFound("nobody")
+
+	if err := serverTp.Unregister("echo"); err != nil {
+		t.Fatal(err)
+	}
+	notFound("echo")
+
+	// names go away with their endpoint
+	serverTp.Register("echo", echo)
+	echo.Close()
+	notFound("echo")
+}
+
+func hasLocalConnection(node *LocalNode, to EndPointAddress) bool {
+	return node.getLocalConnection(membershipChannelID, to) != nil
+}
+
+// awaitMember reads events of m until node reaches state. seen holds the
+// last state of every node reported so far.
+func awaitMember(t *testing.T, m *Membership, seen map[EndPointAddress]MemberState, node EndPointAddress, state MemberState) {
+	deadline := time.After(10 * time.Second)
+	for {
+		if s, ok := seen[node]; ok && s == state {
+			return
+		}
+		select {
+		case e := <-m.Events():
+			seen[e.Node] = e.State
+		case <-deadline:
+			t.Fatalf("%v never became %v: %v", node, state, m.Members())
+		}
+	}
+}
+
+func TestMembershipMessageCodec(t *testing.T) {
+	long := NewEndPointAddress(strings.Repeat("a", maxAddressHostLength)+":80", 1)
+	updates := []update{{MemberSuspect, 7, long}, {MemberAlive, 1, NewEndPointAddress("127.0.0.1:9999", 2)}}
+	bs, err := encodeMembershipMessage(msgPingReq, 3, 5, &long, updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind, seq, incarnation, target, got, err := decodeMembershipMessage(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != msgPingReq || seq != 3 || incarnation != 5 || *target != long {
+		t.Fatal(kind, seq, incarnation, target)
+	}
+	if len(got) != len(updates) || got[0] != updates[0] || got[1] != updates[1] {
+		t.Fatal(got)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	var nodes []*LocalNode
+	var members []*Membership
+	var seen []map[EndPointAddress]MemberState
+	var addrs []EndPointAddress
+	for i := 0; i < 4; i++ {
+		transport, err := CreateTransport("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := NewLocalNode(transport, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := StartMembership(node,
+			WithProbeInterval(50*time.Millisecond),
+			WithProbeTimeout(20*time.Millisecond),
+			WithSuspicionTimeout(300*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		nodes = append(nodes, node)
+		members = append(members, m)
+		seen = append(seen, make(map[EndPointAddress]MemberState))
+		addrs = append(addrs, node.localEndPoint.Address())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, m := range members[1:] {
+		if err := m.Join(ctx, addrs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, m := range members {
+		for j, addr := range addrs {
+			if i != j {
+				awaitMember(t, m, seen[i], addr, MemberAlive)
+			}
+		}
+	}
+
+	// partition node 3 off
+	heal := []func(){partition(members[3], addrs[:3]...)}
+	for _, m := range members[:3] {
+		heal = append(heal, partition(m, addrs[3]))
+	}
+	for i, m := range members[:3] {
+		awaitMember(t, m, seen[i], addrs[3], MemberDead)
+	}
+	for deadline := time.Now().Add(5 * time.Second); hasLocalConnection(nodes[0], addrs[3]); {
+		if time.Now().After(deadline) {
+			t.Fatal("kept the connection to a dead node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// once healed, node 3 refutes its death and is back
+	for _, h := range heal {
+		h()
+	}
+	for i, m := range members[:3] {
+		awaitMember(t, m, seen[i], addrs[3], MemberAlive)
+	}
+}
+
+// partition drops all of m's traffic with the given nodes, as a network
+// partition would, until the returned func is called.
+func partition(m *Membership, nodes ...EndPointAddress) (heal func()) {
+	cut := make(map[EndPointAddress]bool)
+	for _, node := range nodes {
+		cut[node] = true
+	}
+	m.mtx.Lock()
+	m.drop = func(peer EndPointAddress) bool { return cut[peer] }
+	m.mtx.Unlock()
+	return func() {
+		m.mtx.Lock()
+		m.drop = nil
+		m.mtx.Unlock()
+	}
+}
+
+func watcherCount(node *LocalNode, chanID ChannelID) int {
+	ms := node.localMonitors
+	ms.Lock()
+	defer ms.Unlock()
+
+	return len(ms.watchers[chanID])
+}
+
+func awaitDown(t *testing.T, ch *LocalChannel, target ChannelRef) DiedReason {
+	select {
+	case down := <-ch.Down:
+		if down.Ref.Target != target {
+			t.Fatal("down of", down.Ref.Target, "expected", target)
+		}
+		return down.Reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("no down for", target)
+	}
+	return nil
+}
+
+func TestReservedChannelIDs(t *testing.T) {
+	tp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	node, err := NewLocalNode(tp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chanID := range []ChannelID{firstTaskChannelID, firstReservedChannelID, spawnChannelID, rpcChannelID, nodeControllerChannelID, membershipChannelID} {
+		if _, err := NewLocalChannel(node, chanID, nil); !errors.Is(err, ErrReservedChannelID) {
+			t.Fatal(chanID, err)
+		}
+	}
+	if _, err := NewLocalChannel(node, firstTaskChannelID-1, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := StartMembership(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+}
+
+func TestMonitor(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := NewLocalNode(tpA, nil)
+	nodeB, _ := NewLocalNode(tpB, nil)
+	watcher, _ := NewLocalChannel(nodeA, 1, nil)
+	awaitWatched := func(chanID ChannelID) {
+		for deadline := time.Now().Add(5 * time.Second); watcherCount(nodeB, chanID) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("monitor never reached", chanID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a remote channel closed by its owner
+	closed, _ := NewLocalChannel(nodeB, 2, nil)
+	target := nodeB.channelRef(2)
+	Monitor(watcher, target)
+	awaitWatched(2)
+	CloseLocalChannel(closed)
+	if reason := awaitDown(t, watcher, target); reason != (DiedNormal{}) {
+		t.Fatal(reason)
+	}
+
+	// no such channel
+	target = nodeB.channelRef(42)
+	Monitor(watcher, target)
+	if reason := awaitDown(t, watcher, target); reason != (DiedUnknownId{}) {
+		t.Fatal(reason)
+	}
+
+	// killing a remote channel kills what is linked to it
+	NewLocalChannel(nodeB, 3, nil)
+	linked, _ := NewLocalChannel(nodeA, 3, nil)
+	Link(linked, nodeB.channelRef(3))
+	awaitWatched(3)
+	target = nodeA.channelRef(3)
+	Monitor(watcher, target)
+	if err := nodeA.Kill(nodeB.channelRef(3), "stop"); err != nil {
+		t.Fatal(err)
+	}
+	if reason, ok := awaitDown(t, watcher, target).(*DiedException); !ok {
+		t.Fatal(reason)
+	}
+	if nodeA.getLocalChannel(3) != nil || nodeB.getLocalChannel(3) != nil {
+		t.Fatal("linked channels survived")
+	}
+
+	// losing the node
+	NewLocalChannel(nodeB, 4, nil)
+	target = nodeB.channelRef(4)
+	Monitor(watcher, target)
+	awaitWatched(4)
+	nodeB.localEndPoint.Close()
+	if reason := awaitDown(t, watcher, target); reason != (DiedNodeDown{}) {
+		t.Fatal(reason)
+	}
+}
+
+func TestMonitorIdsOfTwoNodes(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpA.Close()
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpB.Close()
+	nodeA, err := NewLocalNode(tpA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := NewLocalNode(tpB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewLocalChannel(nodeA, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLocalChannel(nodeB, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewLocalChannel(nodeB, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitWatched := func(node *LocalNode, chanID ChannelID) {
+		for deadline := time.Now().Add(5 * time.Second); watcherCount(node, chanID) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("monitor never reached", chanID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// node B keeps its own monitor of a and the other half of a's link,
+	// which both nodes gave the same id
+	target := nodeA.channelRef(1)
+	mon := Monitor(watcher, target)
+	awaitWatched(nodeA, 1)
+	link := Link(a, nodeB.channelRef(1))
+	awaitWatched(nodeB, 1)
+	if mon.Id != link.Id {
+		t.Fatal("ids", mon.Id, link.Id)
+	}
+
+	if err := nodeA.Kill(target, "stop"); err != nil {
+		t.Fatal(err)
+	}
+	if reason, ok := awaitDown(t, watcher, target).(*DiedException); !ok {
+		t.Fatal(reason)
+	}
+	for deadline := time.Now().Add(5 * time.Second); nodeB.getLocalChannel(1) != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("linked channel survived")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMonitorClosedNode(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpA.Close()
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA, err := NewLocalNode(tpA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := NewLocalNode(tpB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewLocalChannel(nodeA, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := nodeB.channelRef(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodeB.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tpB.Close()
+
+	// nodeA never reaches nodeB, so no connection is ever lost
+	Monitor(watcher, target)
+	if reason := awaitDown(t, watcher, target); reason != (DiedDisconnect{}) {
+		t.Fatal(reason)
+	}
+}
+
+func TestCall(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := NewLocalNode(tpA, nil)
+	nodeB, _ := NewLocalNode(tpB, nil)
+	addrB := nodeB.localEndPoint.Address()
+
+	echo, _ := NewLocalChannel(nodeB, 1, nil)
+	HandleCalls(echo, func(ctx context.Context, from EndPointAddress, request []byte) ([]byte, error) {
+		if string(request) == "fail" {
+			return nil, errors.New("failed")
+		}
+		return request, nil
+	})
+	entered := make(chan struct{}, 1)
+	cancelled := make(chan struct{})
+	slow, _ := NewLocalChannel(nodeB, 2, nil)
+	HandleCalls(slow, func(ctx context.Context, from EndPointAddress, request []byte) ([]byte, error) {
+		entered <- struct{}{}
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if response, err := nodeA.Call(ctx, addrB, 1, []byte("ping")); err != nil || string(response) != "ping" {
+		t.Fatal(string(response), err)
+	}
+	callError := func(chanID ChannelID, request string, code CallErrorCode) {
+		var ce *CallError
+		_, err := nodeA.Call(ctx, addrB, chanID, []byte(request))
+		if !errors.As(err, &ce) || ce.Code != code {
+			t.Fatal("call to", chanID, ":", err)
+		}
+	}
+	callError(1, "fail", CallHandlerFailed)
+	callError(3, "ping", CallNoSuchChannel)
+	CloseLocalChannel(echo)
+	callError(1, "ping", CallNoSuchChannel)
+
+	// the callee sees the deadline, and the caller giving up
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if _, err := nodeA.Call(short, addrB, 2, nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	<-entered
+	<-cancelled
+	abandoned, abandon := context.WithCancel(ctx)
+	go func() {
+		<-entered
+		abandon()
+	}()
+	if _, err := nodeA.Call(abandoned, addrB, 2, nil); err != context.Canceled {
+		t.Fatal(err)
+	}
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Fatal("handler was not cancelled")
+	}
+
+	// a call without a deadline fails when the callee is lost
+	failed := make(chan error)
+	go func() {
+		_, err := nodeA.Call(context.Background(), addrB, 2, nil)
+		failed <- err
+	}()
+	<-entered
+	nodeB.localEndPoint.Close()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatal("call to a lost node succeeded")
+		}
+	case <-ctx.Done():
+		t.Fatal("call to a lost node hangs")
+	}
+}
+
+type point struct {
+	X, Y int32
+}
+
+func TestCodec(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := NewLocalNode(tpA, nil)
+	nodeB, _ := NewLocalNode(tpB, nil)
+	addrB := nodeB.localEndPoint.Address()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i, serializer := range []Serializer{GobSerializer, JSONSerializer, BinarySerializer} {
+		codec := NewCodec(serializer)
+		if err := codec.Register(1, point{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := codec.Register(2, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := codec.Register(1, uint64(0)); err == nil {
+			t.Fatal("registered a tag twice")
+		}
+		chanID := ChannelID(i + 1)
+		sender, _ := NewLocalChannel(nodeA, chanID, nil)
+		receiver, _ := NewLocalChannel(nodeB, chanID, nil)
+		SetCodec(sender, codec)
+		SetCodec(receiver, codec)
+
+		if err := SendTyped(sender, addrB, &point{1, -2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := SendTyped(sender, addrB, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		if err := SendTyped(sender, addrB, 3.5); err == nil {
+			t.Fatal("sent an unregistered type")
+		}
+		if err := SendTyped(sender, addrB, nil); err == nil {
+			t.Fatal("sent nil")
+		}
+		if err := SendTyped(sender, addrB, (*point)(nil)); err == nil {
+			t.Fatal("sent a nil pointer")
+		}
+		if _, v, err := ReceiveTyped(ctx, receiver); err != nil || v != (point{1, -2}) {
+			t.Fatal(serializer, v, err)
+		}
+		if _, v, err := ReceiveTyped(ctx, receiver); err != nil || v != "hello" {
+			t.Fatal(serializer, v, err)
+		}
+
+		SendPayload(sender, addrB, []byte{0, 0, 0, 9})
+		if _, _, err := ReceiveTyped(ctx, receiver); !errors.Is(err, ErrUnknownTag) {
+			t.Fatal(serializer, err)
+		}
+	}
+}
+
+func TestCloseLocalChannel(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := NewLocalNode(tpA, nil)
+	nodeB, _ := NewLocalNode(tpB, nil)
+	addrA := nodeA.localEndPoint.Address()
+	addrB := nodeB.localEndPoint.Address()
+	chA, _ := NewLocalChannel(nodeA, 1, nil)
+	chB, _ := NewLocalChannel(nodeB, 1, nil)
+
+	if err := SendPayload(chB, addrA, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	<-chA.Queue
+	for _, msg := range []string{"one", "two"} {
+		if err := SendPayload(chA, addrB, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(chB.Queue) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("messages never arrived")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// what was queued can be read, then the queue ends
+	if err := CloseLocalChannel(chB); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for msg := range chB.Queue {
+		got = append(got, string(msg.Payload))
+	}
+	if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Fatal(got)
+	}
+	if err := SendPayload(chB, addrA, []byte("hi")); err != ErrLocalChannelClosed {
+		t.Fatal(err)
+	}
+	if nodeB.getLocalConnection(1, addrA) != nil {
+		t.Fatal("kept a connection of a closed channel")
+	}
+
+	// the sender finds out its messages go nowhere
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		err := SendPayload(chA, addrB, []byte("lost"))
+		if errors.Is(err, ErrChannelRejected) {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatal("not rejected:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// and dialing again finds nothing
+	if err := SendPayload(chA, addrB, []byte("again")); !errors.Is(err, ErrChannelNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalNodeClose(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := NewLocalNode(tpA, nil)
+	nodeB, _ := NewLocalNode(tpB, nil)
+	addrB := nodeB.localEndPoint.Address()
+	chA, _ := NewLocalChannel(nodeA, 1, nil)
+	chB, _ := NewLocalChannel(nodeB, 1, nil)
+	if err := SendPayload(chA, addrB, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	<-chB.Queue
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodeB.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-nodeB.Done():
+	default:
+		t.Fatal("closed node is not done")
+	}
+	if _, ok := <-chB.Queue; ok {
+		t.Fatal("queue of a closed node still open")
+	}
+	if _, err := NewLocalChannel(nodeB, 2, nil); err == nil {
+		t.Fatal("opened a channel on a closed node")
+	}
+	if err := SendPayload(chB, nodeA.localEndPoint.Address(), nil); err == nil {
+		t.Fatal("sent from a closed node")
+	}
+	if err := nodeB.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a node whose endpoint fails is done by itself
+	nodeA.localEndPoint.Close()
+	select {
+	case <-nodeA.Done():
+	case <-ctx.Done():
+		t.Fatal("node outlived its endpoint")
+	}
+
+	// a node whose Close runs out of time still stops
+	expired, expire := context.WithCancel(context.Background())
+	expire()
+	for i := 0; i < 4; i++ {
+		tpC, err := CreateTransport("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodeC, err := NewLocalNode(tpC, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodeC.Close(expired)
+		select {
+		case <-nodeC.Done():
+		case <-ctx.Done():
+			t.Fatal("node left half closed by a timed out Close")
+		}
+	}
+}
+
+// newNode starts a node on tp; the node and tp are closed when the test
+// ends.
+func newNode(t *testing.T, tp *Transport) *LocalNode {
+	t.Helper()
+	node, err := NewLocalNode(tp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		node.Close(ctx)
+		tp.Close()
+	})
+	return node
+}
+
+func newChannel(t *testing.T, node *LocalNode, chanID ChannelID) *LocalChannel {
+	t.Helper()
+	ch, err := NewLocalChannel(node, chanID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestPeerEvents(t *testing.T) {
+	var tps []*TCPTransport
+	var nodes []*LocalNode
+	for i := 0; i < 3; i++ {
+		tp, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tps = append(tps, tp)
+		nodes = append(nodes, newNode(t, tp.ToTransport()))
+	}
+	addrA := nodes[0].localEndPoint.Address()
+	chA := newChannel(t, nodes[0], 1)
+	events := PeerEvents(chA)
+	reasons := make(chan DiedReason, 2)
+	OnDisconnect(chA, func(_ EndPointAddress, reason DiedReason) {
+		reasons <- reason
+	})
+	expect := func(peer *LocalNode, kind PeerEventKind, reason DiedReason) {
+		t.Helper()
+		want := PeerEvent{peer.localEndPoint.Address(), kind}
+		select {
+		case event := <-events:
+			if event != want {
+				t.Fatal(event, "want", want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event", want)
+		}
+		if reason == nil {
+			return
+		}
+		if got := <-reasons; got != reason {
+			t.Fatal(got, "want", reason)
+		}
+	}
+
+	// a peer that closes its channel
+	chB := newChannel(t, nodes[1], 1)
+	for i := 0; i < 2; i++ {
+		if err := SendPayload(chB, addrA, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(nodes[1], PeerConnected, nil)
+	CloseLocalChannel(chB)
+	expect(nodes[1], PeerDisconnected, DiedNormal{})
+
+	// a peer whose sockets break
+	chC := newChannel(t, nodes[2], 1)
+	if err := SendPayload(chC, addrA, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	expect(nodes[2], PeerConnected, nil)
+	breakSockets(tps[2], nodes[2].localEndPoint.Address().EndPointId, addrA)
+	expect(nodes[2], PeerLost, DiedDisconnect{})
+
+	CloseLocalChannel(chA)
+	if _, ok := <-events; ok {
+		t.Fatal("events of a closed channel still open")
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA := newNode(t, tpA)
+	nodeB := newNode(t, tpB)
+	addrA := nodeA.localEndPoint.Address()
+	// fill sends extra messages more than fit to the channel chanID of nodeA
+	fill := func(chanID ChannelID, policy OverflowPolicy, extra int, configure ...func(*LocalChannel)) (*LocalChannel, *LocalChannel) {
+		to := newChannel(t, nodeA, chanID)
+		SetOverflowPolicy(to, policy)
+		for _, f := range configure {
+			f(to)
+		}
+		from := newChannel(t, nodeB, chanID)
+		for i := 0; i < defaultChannelQueueCapacity+extra; i++ {
+			if err := SendPayload(from, addrA, []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			stats := Stats(to)
+			if stats.Delivered+stats.Dropped+uint64(stats.Backlog) == uint64(defaultChannelQueueCapacity+extra) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("messages never arrived", stats)
+			}
+		}
+		return from, to
+	}
+	first := func(to *LocalChannel) string {
+		return string((<-to.Queue).Payload)
+	}
+
+	// a full channel holds up no other
+	_, slow := fill(1, OverflowBlock, 10)
+	if stats := Stats(slow); stats.Backlog != 10 || stats.Dropped != 0 {
+		t.Fatal(stats)
+	}
+	other := newChannel(t, nodeA, 2)
+	sender := newChannel(t, nodeB, 2)
+	if err := SendPayload(sender, addrA, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-other.Queue:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked behind a full channel")
+	}
+	for i := 0; i < defaultChannelQueueCapacity+10; i++ {
+		if msg := first(slow); msg != fmt.Sprint(i) {
+			t.Fatal("got", msg, "want", i)
+		}
+	}
+
+	// a full backlog drops what does not fit
+	_, bounded := fill(6, OverflowBlock, 10, func(to *LocalChannel) {
+		if err := SetBacklogLimit(to, 4, OverflowDropNewest); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if stats := Stats(bounded); stats.Backlog != 4 || stats.Dropped != 6 {
+		t.Fatal(stats)
+	}
+	for i := 0; i < defaultChannelQueueCapacity+4; i++ {
+		if msg := first(bounded); msg != fmt.Sprint(i) {
+			t.Fatal("got", msg, "want", i)
+		}
+	}
+	if err := SetBacklogLimit(bounded, 4, OverflowBlock); err == nil {
+		t.Fatal("a full backlog blocks")
+	}
+
+	_, newest := fill(3, OverflowDropNewest, 5)
+	if stats := Stats(newest); stats.Dropped != 5 || first(newest) != "0" {
+		t.Fatal(stats)
+	}
+
+	_, oldest := fill(4, OverflowDropOldest, 5)
+	if stats := Stats(oldest); stats.Dropped != 5 || first(oldest) != "5" {
+		t.Fatal(stats)
+	}
+
+	from, _ := fill(5, OverflowError, 1)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if err := from.checkSend(addrA); errors.Is(err, ErrChannelOverflow) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sender never told of the overflow")
+		}
+	}
+}
+
+func TestRedial(t *testing.T) {
+	tpA, err := createTCPTransport("127.0.0.1:0", defaultTCPParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA := newNode(t, tpA.ToTransport())
+	nodeB := newNode(t, tpB)
+	addrB := nodeB.localEndPoint.Address()
+	chA := newChannel(t, nodeA, 1)
+	chB := newChannel(t, nodeB, 1)
+	SetRedial(nodeA, WithRedialAttempts(3), WithRedialBackoff(10*time.Millisecond, 20*time.Millisecond))
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case msg := <-chB.Queue:
+			if string(msg.Payload) != want {
+				t.Fatal("got", string(msg.Payload), "want", want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing received")
+		}
+	}
+
+	if err := SendPayload(chA, addrB, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	receive("before")
+	conn := nodeA.getLocalConnection(1, addrB)
+	breakSockets(tpA, nodeA.localEndPoint.Address().EndPointId, addrB)
+	for deadline := time.Now().Add(5 * time.Second); nodeA.getLocalConnection(1, addrB) == conn; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("lost connection still cached")
+		}
+	}
+	if err := SendPayload(chA, addrB, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	receive("after")
+
+	// a node that is gone for good
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodeB.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tpB.Close()
+	start := time.Now()
+	if err := SendPayload(chA, addrB, []byte("gone")); !errors.Is(err, ErrUnreachable) {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatal("gave up without backing off")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	var tos []EndPointAddress
+	var queues []chan Message
+	for i := 0; i < 4; i++ {
+		tp, err := CreateTransport("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := newNode(t, tp)
+		ch := newChannel(t, node, 1)
+		tos = append(tos, node.localEndPoint.Address())
+		queues = append(queues, ch.Queue)
+	}
+	tp, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := newNode(t, tp)
+	SetRedial(node, WithRedialAttempts(1))
+	from := newChannel(t, node, 1)
+
+	results := Broadcast(from, tos, []byte("hi"))
+	for i, res := range results {
+		if res.To != tos[i] || res.Err != nil {
+			t.Fatal(res)
+		}
+		if msg := <-queues[i]; string(msg.Payload) != "hi" {
+			t.Fatal(msg)
+		}
+	}
+
+	// nobody listens there
+	gone := tos[0]
+	gone.EndPointId = 4242
+	results = Broadcast(from, append(tos, gone), []byte("again"))
+	if results[len(tos)].Err == nil {
+		t.Fatal("sent to a missing endpoint")
+	}
+	for _, res := range results[:len(tos)] {
+		if res.Err != nil {
+			t.Fatal(res)
+		}
+	}
+
+	// waiting for more than there are waits for all
+	results = Broadcast(from, tos, []byte("all"), WithWaitFor(len(tos)+1))
+	for _, res := range results {
+		if res.Err != nil {
+			t.Fatal(res)
+		}
+	}
+
+	results = Broadcast(from, tos, []byte("late"), WithWaitFor(0))
+	for _, res := range results {
+		if res.Err != ErrSendPending {
+			t.Fatal(res)
+		}
+	}
+	for _, queue := range queues {
+		if msg := <-queue; string(msg.Payload) != "again" {
+			t.Fatal(msg)
+		}
+		if msg := <-queue; string(msg.Payload) != "all" {
+			t.Fatal(msg)
+		}
+		if msg := <-queue; string(msg.Payload) != "late" {
+			t.Fatal(msg)
+		}
+	}
+}
+
+func TestOpenChannel(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA := newNode(t, tpA)
+	nodeB := newNode(t, tpB)
+	addrB := nodeB.localEndPoint.Address()
+
+	// a mistyped channel id
+	typo := newChannel(t, nodeA, 7)
+	if err := DialTo(typo, addrB); !errors.Is(err, ErrChannelNotFound) {
+		t.Fatal(err)
+	}
+	if nodeA.getLocalConnection(7, addrB) != nil {
+		t.Fatal("kept the connection to a missing channel")
+	}
+
+	chB := newChannel(t, nodeB, 1)
+	var from ChannelRef
+	OnOpen(chB, func(ref ChannelRef, metadata []byte) error {
+		from = ref
+		if string(metadata) != "v2" {
+			return fmt.Errorf("want v2, got %q", metadata)
+		}
+		return nil
+	})
+	chA := newChannel(t, nodeA, 1)
+	if err := DialTo(chA, addrB); !errors.Is(err, ErrChannelRefused) {
+		t.Fatal(err)
+	}
+	SetOpenMetadata(chA, []byte("v2"))
+	if err := DialTo(chA, addrB); err != nil {
+		t.Fatal(err)
+	}
+	if from != nodeA.channelRef(1) {
+		t.Fatal("opened by", from)
+	}
+	if err := SendPayload(chA, addrB, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-chB.Queue; string(msg.Payload) != "hi" {
+		t.Fatal(msg)
+	}
+
+	// an endpoint that is no node never answers
+	bare, err := tpB.NewEndPoint(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOpenTimeout(nodeA, 50*time.Millisecond)
+	start := time.Now()
+	if err := DialTo(chA, bare.Address()); err == nil {
+		t.Fatal("opened a channel on a bare endpoint")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("open timeout ignored")
+	}
+}
+
+func TestConcurrentDial(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpA.Close()
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpB.Close()
+	nodeA, err := NewLocalNode(tpA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := NewLocalNode(tpB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrA := nodeA.localEndPoint.Address()
+	addrB := nodeB.localEndPoint.Address()
+	chA, err := NewLocalChannel(nodeA, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chB, err := NewLocalChannel(nodeB, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const senders = 8
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := SendPayload(chA, addrB, []byte("hi")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < senders; i++ {
+		select {
+		case <-chB.Queue:
+		case <-time.After(5 * time.Second):
+			t.Fatal("got", i, "of", senders)
+		}
+	}
+
+	// the connections that lost the race are closed, not leaked
+	for deadline := time.Now().Add(5 * time.Second); peerConnections(chB, addrA) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal(peerConnections(chB, addrA), "connections from", addrA)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func peerConnections(localChannel *LocalChannel, peer EndPointAddress) int {
+	peers := localChannel.peers
+	peers.Lock()
+	defer peers.Unlock()
+
+	return peers.count[peer]
+}
+
+func TestSpawn(t *testing.T) {
+	tpA, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpB, err := CreateTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA := newNode(t, tpA)
+	nodeB := newNode(t, tpB)
+	addrB := nodeB.localEndPoint.Address()
+	codec := NewCodec(GobSerializer)
+	if err := codec.Register(1, point{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.Register(2, int32(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	for name, fn := range map[string]Function{
+		"add": func(ctx context.Context, task *LocalChannel, args any) (any, error) {
+			p := args.(point)
+			return p.X + p.Y, nil
+		},
+		"fail": func(ctx context.Context, task *LocalChannel, args any) (any, error) {
+			return nil, errors.New("no luck")
+		},
+		"wait": func(ctx context.Context, task *LocalChannel, args any) (any, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	} {
+		if err := RegisterFunction(nodeB, name, codec, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterFunction(nodeB, "add", codec, nil); err == nil {
+		t.Fatal("registered a name twice")
+	}
+
+	caller := newChannel(t, nodeA, 1)
+	SetCodec(caller, codec)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	spawn := func(name string) (*Task, TaskResult) {
+		t.Helper()
+		task, err := Spawn(ctx, caller, addrB, name, point{2, -3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return task, <-task.Result
+	}
+
+	task, res := spawn("add")
+	if res.Err != nil || res.Value != int32(-1) {
+		t.Fatal(res)
+	}
+	if task.Ref.Channel < firstTaskChannelID || task.Ref.Channel >= firstReservedChannelID {
+		t.Fatal("task", task.Ref.Channel, "outside the task ids")
+	}
+	if reason := awaitDown(t, caller, task.Ref); reason != (DiedNormal{}) {
+		t.Fatal(reason)
+	}
+
+	task, res = spawn("fail")
+	var callErr *CallError
+	if !errors.As(res.Err, &callErr) || callErr.Code != CallHandlerFailed {
+		t.Fatal(res)
+	}
+	if reason, ok := awaitDown(t, caller, task.Ref).(*DiedException); !ok {
+		t.Fatal(reason)
+	}
+
+	// a function the callee does not have leaves nothing to watch
+	if _, err := Spawn(ctx, caller, addrB, "missing", point{}); !errors.As(err, &callErr) || callErr.Code != CallHandlerFailed {
+		t.Fatal(err)
+	}
+
+	// a run that is never asked for never starts
+	SetOpenTimeout(nodeB, 50*time.Millisecond)
+	body, err := codec.Encode(point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := nodeA.Call(ctx, addrB, spawnChannelID, encodeSpawn("add", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned := ChannelRef{addrB, ChannelID(binary.BigEndian.Uint64(response))}
+	Monitor(caller, abandoned)
+	if reason := awaitDown(t, caller, abandoned); reason != (DiedUnknownId{}) {
+		t.Fatal(reason)
+	}
+
+	// the node running the task goes down
+	task, err = Spawn(ctx, caller, addrB, "wait", point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	nodeB.localEndPoint.Close()
+	if reason := awaitDown(t, caller, task.Ref); reason != (DiedNodeDown{}) {
+		t.Fatal(reason)
+	}
+	if res := <-task.Result; res.Err == nil {
+		t.Fatal(res)
+	}
+}
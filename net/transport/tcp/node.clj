@@ -5,7 +5,19 @@
 (struct LocalNode
     localEndPoint   *EndPoint
     localState      (MVar LocalNodeState)
-    localCtrlChan   (Chan NCMsg))
+    localCtrlChan   (Chan NCMsg)
+    ;; | Monitors and links, kept by the node controller
+    localMonitors   *Monitors
+    ;; | Calls made and served
+    localRPC        *RPC
+    ;; | Functions other nodes can spawn
+    localFunctions  *Functions
+    ;; | Tells when the node's goroutines are done
+    localLife       *Lifecycle
+    ;; | How sends re-dial connections that failed
+    localRedial     *Redial
+    ;; | Connections opened, waiting for their answer
+    localOpens      *Opens)
 
 
 (enum LocalNodeState
@@ -19,7 +31,11 @@
 (struct ValidLocalNodeState
     localSwitches       (Map ChannelID *LocalChannel)
     ;; | Outgoing connections
-    localConnections    OutgoingConnectionMap)
+    localConnections    OutgoingConnectionMap
+    ;; | Remote channels that turned our messages away, see checkSend
+    localRejected       (Set ChannelRef)
+    ;; | Remote channels that dropped our messages, see checkSend
+    localOverflowed     (Set ChannelRef))
 
 
 (defmacro withValidLocalNodeState! [node vst & body]
@@ -46,17 +62,43 @@
             (return
                 (get-in vst.localConnections [from to])))
         
+        (return nil))
+
+    ;; | Records conn as the connection of channel from to the endpoint to,
+    ;; | unless another one got there first, which is returned instead
+    (defn keepLocalConnection ^*Connection
+        [^ChannelID from ^EndPointAddress to ^*Connection conn]
+        (withValidLocalNodeState! localNode vst
+            (let other (get-in vst.localConnections [from to]))
+            (when (not (nil? other))
+                (return other))
+            (assoc-in vst.localConnections [from to] conn))
+
         (return nil)))
 
 
 (def defaultChannelQueueCapacity 4096)
+(def defaultCtrlChanCapacity 64)
+(def defaultDownCapacity 64)
 
 
 (struct LocalChannel
     channelID       ChannelID
     localNode       *LocalNode
     Queue           (Chan Message)
-    onConnect       (fn [EndPointAddress]))
+    ;; | Notifications of the monitored channels that died
+    Down            (Chan ChannelDown)
+    onConnect       (fn [EndPointAddress])
+    ;; | Peers connected to the channel, see OnDisconnect and PeerEvents
+    peers           *Peers
+    ;; | Closes Queue once nothing is delivered to it
+    queueGate       *QueueGate
+    ;; | Overflow policy, and the messages that wait for room in Queue
+    mailbox         *Mailbox
+    ;; | Metadata sent, and check of those received, when connections open
+    handshake       *Handshake
+    ;; | Encodes and decodes typed messages, see SetCodec
+    codec           *Codec)
 
 
 ;;;------------------------------------------------------------------------------
@@ -74,29 +116,43 @@
                                 {localConnections (newOutgoingConnectionMap)}))
         node (map->LocalNode
                 {localEndPoint endpoint
-                 localState (^LocalNodeState newMVar &st)})
+                 localState (^LocalNodeState newMVar &st)
+                 localCtrlChan (^NCMsg chan defaultCtrlChanCapacity)
+                 localMonitors (newMonitors)
+                 localLife (newLifecycle)
+                 localRedial (newRedial)
+                 localOpens (newOpens)}))
 
-        stopNC  (fn []
-                    (>! node.localCtrlChan (NCMsg. (node.localEndPoint.Address) (SigShutdown.)))))
+    (<- (node.startRPC))
+    (<- (node.startFunctions))
 
     ;; Once the NC terminates, the endpoint isn't much use,
     (go (try (nodeController &node)
-             (finally (node.localEndPoint.Close))))
+             (finally (node.controllerExited))))
 
     ;; whilst a closed/failing endpoint will terminate the NC
     (go (try (handleNodeMessages &node)
-             (finally (stopNC))))
+             (finally (node.stopNC))))
+
+    ;; and once both are gone, so is the node
+    (go (node.awaitExit))
 
     (return &node))
 
 
-(defn NewLocalChannel ^*LocalChannel
+;;; | Opens channel sid on the node, reserved ids included; see NewLocalChannel
+(defn newLocalChannel ^*LocalChannel
     [^*LocalNode localNode, ^ChannelID sid, ^"func (EndPointAddress)" onConnect]
 
     (withValidLocalNodeState! localNode vst
         (let localChannel (map->LocalChannel {channelID sid, 
                                               localNode localNode,
                                               Queue (^Message chan defaultChannelQueueCapacity)
+                                              Down (^ChannelDown chan defaultDownCapacity)
+                                              queueGate (newQueueGate)
+                                              mailbox (newMailbox)
+                                              handshake (newHandshake)
+                                              peers (newPeers)
                                               onConnect onConnect})) 
                             
         (when (== nil (get vst.localSwitches sid))
@@ -110,17 +166,28 @@
 
 (defn CloseLocalChannel
     [^*LocalChannel localChannel]
+    (let node localChannel.localNode)
+    (<- conns (node.removeLocalChannel localChannel.channelID))
+    (localChannel.shutdown conns)
+    ;; tell whoever monitors the channel
+    (node.signal (&Died. (node.channelRef localChannel.channelID) (DiedNormal.)))
+    (return nil))
 
-    (withValidLocalNodeState! localChannel.localNode vst
-        (let localSwitch_ (get vst.localSwitches localChannel.channelID))
-        (if (nil? localSwitch_)
-            (throw "local switch closed")
-            (do
-                (.remove vst.localSwitches localChannel.channelID)
-                (.remove vst.localConnections localChannel.channelID)
-                (return nil))))
-    ; LocalNodeClosed
-    (throw "local node closed"))
+
+(impl ^*LocalNode localNode
+    ;; | Unregister a channel, and hand over its outgoing connections
+    (defn removeLocalChannel ^"map[EndPointAddress]*Connection" [^ChannelID chanID]
+        (withValidLocalNodeState! localNode vst
+            (let localSwitch_ (get vst.localSwitches chanID)
+                 conns (get vst.localConnections chanID))
+            (if (nil? localSwitch_)
+                (throw "local switch closed")
+                (do
+                    (.remove vst.localSwitches chanID)
+                    (.remove vst.localConnections chanID)
+                    (return conns))))
+        ; LocalNodeClosed
+        (throw "local node closed")))
     
 ;;;------------------------------------------------------------------------------
 ;;; Handle incoming messages                                                   --
@@ -168,7 +235,10 @@
                                     (invalidRequest cid "closed unknown connection")
                                     (do
                                         (.remove st.incoming cid)
-                                        (.remove (get st.incomingFrom pConn.theirAddress) cid))))
+                                        (.remove (get st.incomingFrom pConn.theirAddress) cid)
+                                        (match pConn.theirTarget
+                                            [ToChannel pSwitch]
+                                            (pSwitch.peers.disconnected pConn.theirAddress)))))
         
         onReceived  (fn [^ConnectionId cid, ^ByteString payload]
                         (let pConn (get st.incoming cid))
@@ -178,24 +248,32 @@
                             (match pConn.theirTarget
                                 Uninit
                                 (do
-                                    (let 
-                                        pSwitch (localNode.getLocalChannel
-                                                    (decodeChannelID payload)))
-                                    
-                                    (if (nil? pSwitch)
+                                    ;; the first message opens the connection, see open.go
+                                    (let target (localNode.bind pConn.theirAddress payload))
+                                    (when (nil? target)
                                         (.remove  st.incoming cid)
+                                        return)
+
+                                    (.put st.incoming cid 
+                                        (&IncomingConnection. pConn.theirAddress target))
+                                    (match target
+                                        [ToChannel pSwitch]
                                         (do
-                                            (.put st.incoming cid 
-                                                (&IncomingConnection. pConn.theirAddress (&ToChannel. pSwitch)))
                                             ;; call onConnect callback
                                             (when (not (nil? pSwitch.onConnect))
-                                                (pSwitch.onConnect pConn.theirAddress)))))
+                                                (pSwitch.onConnect pConn.theirAddress))
+                                            (pSwitch.peers.connected pConn.theirAddress))))
+
+                                ToNode
+                                (localNode.controlReceived pConn.theirAddress payload)
 
                                 [ToChannel pSwitch]
                                 (do
                                     (println pSwitch.channelID payload)
-                                    (>! pSwitch.Queue 
-                                        (Message. pConn.theirAddress payload))))))
+                                    ;; the channel closed since the connection opened
+                                    (when (not (pSwitch.deliver (Message. pConn.theirAddress payload)))
+                                        (.remove  st.incoming cid)
+                                        (localNode.reject pConn.theirAddress pSwitch.channelID))))))
 
         onErrorEvent    (fn ^Bool [^EventErrorCode errcode ^Error err]
                             (println errcode err)
@@ -204,9 +282,17 @@
                                 (do
                                     (native
                                         "for cid, _ := range st.incomingFrom[addr] {"
+                                        "   if c := st.incoming[cid]; c != nil {"
+                                        "       if t, ok := c.theirTarget.(*ToChannel); ok {"
+                                        "           t._1.peers.lost(addr)"
+                                        "       }"
+                                        "   }"
                                         "   delete(st.incoming, cid)"
                                         "}")
-                                    (.remove  st.incomingFrom addr))
+                                    (.remove  st.incomingFrom addr)
+                                    ;; our connections to addr are as dead
+                                    (localNode.forgetNode addr)
+                                    (localNode.peerLost addr err))
 
                                 EventEndPointFailed (return true)
                                 EventTransportFailed (return true))
@@ -225,6 +311,10 @@
             [ConnectionClosed cid]
             (onConnectionClosed cid)
 
+            ;; nodes do not take streams, drain them so the sender can finish
+            [ReceivedStream _ stream]
+            (stream.Close)
+
             [ErrorEvent errcode err]
             (do
                 (let exit (onErrorEvent errcode err))
@@ -241,16 +331,16 @@
 (defn DialTo
     [^*LocalChannel localChannel, ^EndPointAddress to]
     (let node localChannel.localNode)
-    (<- _ (connBetween node localChannel.channelID to))
+    (<- (localChannel.checkSend to))
+    (<- (node.connect localChannel.channelID to))
     (return nil))
 
 
 (defn SendPayload
     [^*LocalChannel LocalChannel ^EndPointAddress to ^ByteString payload]
     (let node LocalChannel.localNode)
-    (<- conn (connBetween node LocalChannel.channelID to))
-    (<- bytes (conn.Send payload))
-    (println bytes)
+    (<- (LocalChannel.checkSend to))
+    (<- (node.send LocalChannel.channelID to payload))
     ; (>! node.localCtrlChan (NCMsg. to (&Died. to (DiedDisconnect.))))
     (return nil))
 
@@ -258,14 +348,13 @@
 (defn setupConnBetween ^*Connection
     [^*LocalNode node ^ChannelID from ^EndPointAddress to]
     (<- conn (node.localEndPoint.Dial to))
-    (<- nbytes (conn.Write (encodeChannelID from)))
-    (when (== nbytes 8)
-        (lock! node.localState)
-        (match node.localState.value
-            [LocalNodeValid vst]
-            (assoc-in vst.localConnections [from to] conn))
-        (return conn))
-    (throw "conn failed"))
+    (<- (node.open conn from to))
+    ;; two sends may dial at once; the first connection set up is kept
+    (let other (node.keepLocalConnection from to conn))
+    (when (not (nil? other))
+        (.Close conn)
+        (return other))
+    (return conn))
 
 
 (defn connBetween ^*Connection
@@ -292,8 +381,16 @@
 
 ;;; | Why did a channel die?
 (enum DiedReason
+    ;; | We lost the connection to its node
     DiedDisconnect
-    DiedNodeDown)
+    ;; | Its node went down
+    DiedNodeDown
+    ;; | It was closed by its owner
+    DiedNormal
+    ;; | There was no such channel
+    DiedUnknownId
+    ;; | It was killed, or a channel linked to it died
+    (DiedException String))
 
 
 ;;; | Messages to the node controller
@@ -306,6 +403,11 @@
 (enum Signal
     (Died Identifier DiedReason)
     (Kill ChannelID String)
+    (SigMonitor MonitorRef)
+    (SigUnmonitor MonitorRef)
+    (Rejected ChannelID)
+    (Overflowed ChannelID)
+    (Opened openReply)
     SigShutdown)
 
 
@@ -319,11 +421,33 @@
 
         (match msg.ctrlMsgSignal
             [Died ident reason]
-            (println "Died:" ident reason)
+            (do
+                (node.notifyDied ident reason)
+                (match reason
+                    DiedNodeDown
+                    (node.forgetNode ident)))
+
+            [Kill chanID reason]
+            (node.killChannel chanID reason)
+
+            [SigMonitor ref]
+            (node.monitor ref)
+
+            [SigUnmonitor ref]
+            (node.unmonitor ref)
+
+            [Rejected chanID]
+            (node.rejected msg.ctrlMsgSender chanID)
+
+            [Overflowed chanID]
+            (node.overflowed msg.ctrlMsgSender chanID)
+
+            [Opened reply]
+            (node.opened msg.ctrlMsgSender reply)
 
             SigShutdown
             (do
-                (node.localEndPoint.Close)
+                (node.closeEndPoint false)
                 return))))
 
 ;;;------------------------------------------------------------------------------
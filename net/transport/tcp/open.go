@@ -0,0 +1,280 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+The first message on a connection to a channel opens it:
+
+	open    source target id metadata
+
+source and target are the channel ids of the two ends, id a uint64 picked by
+the node that dials, and metadata what the dialing channel was given by
+SetOpenMetadata. The node controller of the target node answers, over the
+connections between node controllers (see monitor.go), with
+
+	opened  id code [msg]
+
+code being a uint8 openCode and msg the reason of a refusal. Nothing else is
+sent on the connection before the answer. An id of 0 asks for no answer; that
+is how node controllers open their own connections.
+
+A first message of 8 bytes is the target channel alone, as sent by older
+nodes. A target missing then is told with a rejected signal instead.
+*/
+
+var (
+	ErrChannelNotFound = errors.New("channel not found")
+	ErrChannelRefused  = errors.New("channel refused the connection")
+)
+
+// defaultOpenTimeout bounds the wait for the answer to an open, unless
+// SetOpenTimeout says otherwise.
+const defaultOpenTimeout = 10 * time.Second
+
+type openCode uint8
+
+const (
+	openAccepted openCode = iota
+	openNotFound
+	openRefused
+)
+
+// openReply is the answer of a node to an open.
+type openReply struct {
+	id   uint64
+	code openCode
+	msg  string
+}
+
+// Handshake is what a LocalChannel sends and checks when connections open.
+type Handshake struct {
+	sync.Mutex
+	metadata []byte
+	accept   func(from ChannelRef, metadata []byte) error
+}
+
+func newHandshake() *Handshake {
+	return &Handshake{}
+}
+
+// SetOpenMetadata sets the metadata localChannel sends with the connections
+// it opens from now on.
+func SetOpenMetadata(localChannel *LocalChannel, metadata []byte) {
+	hs := localChannel.handshake
+	hs.Lock()
+	defer hs.Unlock()
+	hs.metadata = metadata
+}
+
+// OnOpen makes localChannel take connections only when accept returns nil;
+// the error of accept is told to the dialing node. accept is called on the
+// goroutine that handles the messages of the node, and must not block.
+func OnOpen(localChannel *LocalChannel, accept func(from ChannelRef, metadata []byte) error) {
+	hs := localChannel.handshake
+	hs.Lock()
+	defer hs.Unlock()
+	hs.accept = accept
+}
+
+// Opens are the opens of a node waiting for their answer.
+type Opens struct {
+	sync.Mutex
+	nextId  uint64
+	pending map[uint64]*pendingOpen
+	timeout time.Duration
+}
+
+type pendingOpen struct {
+	to    EndPointAddress
+	reply chan error
+}
+
+func newOpens() *Opens {
+	return &Opens{pending: make(map[uint64]*pendingOpen), timeout: defaultOpenTimeout}
+}
+
+// SetOpenTimeout sets how long node waits for the answer to an open before
+// the connection fails. The default is 10 seconds.
+func SetOpenTimeout(node *LocalNode, timeout time.Duration) {
+	opens := node.localOpens
+	opens.Lock()
+	defer opens.Unlock()
+	opens.timeout = timeout
+}
+
+// open sends the open of channel from on conn, a new connection to the
+// endpoint to, and waits for the answer. conn is closed when it fails.
+func (node *LocalNode) open(conn *Connection, from ChannelID, to EndPointAddress) error {
+	// node controllers are always there
+	if from == nodeControllerChannelID {
+		_, err := conn.Send(encodeOpen(from, from, 0, nil))
+		return err
+	}
+
+	metadata := node.getLocalChannel(from).openMetadata()
+	opens := node.localOpens
+	p := &pendingOpen{to, make(chan error, 1)}
+	opens.Lock()
+	opens.nextId++
+	id := opens.nextId
+	opens.pending[id] = p
+	timeout := opens.timeout
+	opens.Unlock()
+	defer func() {
+		opens.Lock()
+		delete(opens.pending, id)
+		opens.Unlock()
+	}()
+
+	err := func() error {
+		if _, err := conn.Send(encodeOpen(from, from, id, metadata)); err != nil {
+			return err
+		}
+		select {
+		case err := <-p.reply:
+			return err
+		case <-time.After(timeout):
+			return fmt.Errorf("open %v: no answer", ChannelRef{to, from})
+		case <-node.localLife.done:
+			return ErrLocalNodeClosed
+		}
+	}()
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// openMetadata returns the metadata of a channel, which may be gone already.
+func (localChannel *LocalChannel) openMetadata() []byte {
+	if localChannel == nil {
+		return nil
+	}
+	hs := localChannel.handshake
+	hs.Lock()
+	defer hs.Unlock()
+	return hs.metadata
+}
+
+// opened hands the answer to an open to the dial waiting for it.
+func (node *LocalNode) opened(ident Identifier, reply openReply) {
+	from, ok := ident.(EndPointAddress)
+	if !ok {
+		return
+	}
+	opens := node.localOpens
+	opens.Lock()
+	p, ok := opens.pending[reply.id]
+	opens.Unlock()
+	if !ok || p.to != from {
+		return
+	}
+
+	var err error
+	switch reply.code {
+	case openAccepted:
+	case openNotFound:
+		err = ErrChannelNotFound
+	default:
+		err = ErrChannelRefused
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %s", err, reply.msg)
+	}
+	select {
+	case p.reply <- err:
+	default:
+	}
+}
+
+// failOpens fails the opens to a node we lost.
+func (node *LocalNode) failOpens(addr EndPointAddress, err error) {
+	opens := node.localOpens
+	opens.Lock()
+	defer opens.Unlock()
+
+	for _, p := range opens.pending {
+		if p.to == addr {
+			select {
+			case p.reply <- err:
+			default:
+			}
+		}
+	}
+}
+
+// bind reads the open that a new connection from the endpoint from starts
+// with, answers it, and returns what the connection is to; nil when it is
+// turned away.
+func (node *LocalNode) bind(from EndPointAddress, frame []byte) IncomingTarget {
+	source, target, id, metadata, err := decodeOpen(frame)
+	if err != nil {
+		return nil
+	}
+	if target == nodeControllerChannelID {
+		return ToNode{}
+	}
+	ref := ChannelRef{from, source}
+	answer := func(code openCode, msg string) {
+		if id != 0 {
+			node.post(from, encodeOpened(id, code, msg))
+		}
+	}
+
+	localChannel := node.getLocalChannel(target)
+	if localChannel == nil {
+		if id == 0 {
+			node.reject(from, target)
+		}
+		answer(openNotFound, node.channelRef(target).String())
+		return nil
+	}
+	hs := localChannel.handshake
+	hs.Lock()
+	accept := hs.accept
+	hs.Unlock()
+	if accept != nil {
+		if err := accept(ref, metadata); err != nil {
+			answer(openRefused, err.Error())
+			return nil
+		}
+	}
+	answer(openAccepted, "")
+	return &ToChannel{localChannel}
+}
+
+func encodeOpen(source, target ChannelID, id uint64, metadata []byte) []byte {
+	frame := make([]byte, 24, 24+len(metadata))
+	binary.BigEndian.PutUint64(frame, uint64(source))
+	binary.BigEndian.PutUint64(frame[8:], uint64(target))
+	binary.BigEndian.PutUint64(frame[16:], id)
+	return append(frame, metadata...)
+}
+
+func decodeOpen(frame []byte) (source, target ChannelID, id uint64, metadata []byte, err error) {
+	switch {
+	case len(frame) == 8:
+		target = decodeChannelID(frame)
+		return target, target, 0, nil, nil
+	case len(frame) < 24:
+		return 0, 0, 0, nil, errors.New("open too short")
+	}
+	source = ChannelID(binary.BigEndian.Uint64(frame))
+	target = ChannelID(binary.BigEndian.Uint64(frame[8:]))
+	id = binary.BigEndian.Uint64(frame[16:])
+	return source, target, id, frame[24:], nil
+}
+
+func encodeOpened(id uint64, code openCode, msg string) []byte {
+	frame := make([]byte, 10, 10+len(msg))
+	frame[0] = ctrlOpened
+	binary.BigEndian.PutUint64(frame[1:], id)
+	frame[9] = uint8(code)
+	return append(frame, msg...)
+}
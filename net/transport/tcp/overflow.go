@@ -0,0 +1,249 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Messages for all the channels of a node arrive on one endpoint and are handed
+out by one goroutine, which never waits for a channel to make room in its
+Queue: a slow consumer holds up its own channel only. What happens to a
+message that does not fit is the channel's overflow policy.
+
+An OverflowError tells the node controller of the sender, with an overflow
+signal (see monitor.go), and the next send from the sender's channel to it
+fails with ErrChannelOverflow.
+*/
+
+// ErrChannelOverflow is the error of a send after the remote channel dropped
+// one of our messages for want of room.
+var ErrChannelOverflow = errors.New("remote channel dropped our messages")
+
+// OverflowPolicy is what a channel does with a message when its Queue is
+// full.
+type OverflowPolicy uint8
+
+const (
+	// Keep the message, and those after it, in a backlog until there is
+	// room. The sender is never held up: once the backlog is full, messages
+	// are dropped, and by default the sender told as under OverflowError
+	// (see SetBacklogLimit)
+	OverflowBlock OverflowPolicy = iota
+	// Drop the message
+	OverflowDropNewest
+	// Drop the oldest message in the Queue to make room
+	OverflowDropOldest
+	// Drop the message and tell the sender
+	OverflowError
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop newest"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowError:
+		return "error"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", uint8(policy))
+}
+
+// DeliveryStats counts what became of the messages that arrived for a
+// channel.
+type DeliveryStats struct {
+	Delivered uint64 // put in the Queue, and not dropped from it
+	Dropped   uint64 // lost to the overflow policy, or to a full backlog
+	Backlog   int    // waiting for room, under OverflowBlock
+}
+
+// Mailbox keeps the overflow policy of a LocalChannel and what did not fit
+// in its Queue.
+type Mailbox struct {
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	sync.Mutex
+	policy       OverflowPolicy
+	backlog      []Message // the first is being put in the Queue by pump
+	backlogLimit int
+	whenFull     OverflowPolicy // for a message that finds the backlog full
+}
+
+// defaultBacklogLimit is the number of messages a channel keeps under
+// OverflowBlock unless SetBacklogLimit says otherwise.
+const defaultBacklogLimit = 16 * 1024
+
+func newMailbox() *Mailbox {
+	return &Mailbox{backlogLimit: defaultBacklogLimit, whenFull: OverflowError}
+}
+
+// SetOverflowPolicy sets what localChannel does with the messages that find
+// its Queue full. The default is OverflowBlock.
+func SetOverflowPolicy(localChannel *LocalChannel, policy OverflowPolicy) {
+	box := localChannel.mailbox
+	box.Lock()
+	defer box.Unlock()
+	box.policy = policy
+}
+
+// SetBacklogLimit bounds the backlog that localChannel keeps under
+// OverflowBlock to limit messages. A message that finds the backlog full is
+// dropped, and the sender told if whenFull is OverflowError; whenFull is
+// OverflowDropNewest or OverflowError. The default is defaultBacklogLimit and
+// OverflowError.
+func SetBacklogLimit(localChannel *LocalChannel, limit int, whenFull OverflowPolicy) error {
+	if limit < 0 {
+		return fmt.Errorf("backlog limit %d is negative", limit)
+	}
+	if whenFull != OverflowDropNewest && whenFull != OverflowError {
+		return fmt.Errorf("backlog limit: %v is no policy for a full backlog", whenFull)
+	}
+	box := localChannel.mailbox
+	box.Lock()
+	defer box.Unlock()
+	box.backlogLimit = limit
+	box.whenFull = whenFull
+	return nil
+}
+
+// Stats returns the delivery counts of localChannel.
+func Stats(localChannel *LocalChannel) DeliveryStats {
+	box := localChannel.mailbox
+	box.Lock()
+	backlog := len(box.backlog)
+	box.Unlock()
+	return DeliveryStats{
+		Delivered: box.delivered.Load(),
+		Dropped:   box.dropped.Load(),
+		Backlog:   backlog,
+	}
+}
+
+// put queues msg without waiting; the caller holds the gate open.
+func (localChannel *LocalChannel) put(msg Message) {
+	box := localChannel.mailbox
+	box.Lock()
+	defer box.Unlock()
+
+	// behind a backlog, in order
+	if len(box.backlog) > 0 {
+		localChannel.backlogged(msg)
+		return
+	}
+	if localChannel.tryQueue(msg) {
+		return
+	}
+	switch box.policy {
+	case OverflowBlock:
+		localChannel.backlogged(msg)
+	case OverflowDropOldest:
+		select {
+		case <-localChannel.Queue:
+			box.delivered.Add(^uint64(0))
+			box.dropped.Add(1)
+		default:
+		}
+		if !localChannel.tryQueue(msg) {
+			box.dropped.Add(1)
+		}
+	default:
+		localChannel.drop(msg, box.policy)
+	}
+}
+
+// backlogged adds msg to the backlog, unless it is full; the caller holds
+// the lock.
+func (localChannel *LocalChannel) backlogged(msg Message) {
+	box := localChannel.mailbox
+	if len(box.backlog) >= box.backlogLimit {
+		localChannel.drop(msg, box.whenFull)
+		return
+	}
+	box.backlog = append(box.backlog, msg)
+	if len(box.backlog) == 1 {
+		go localChannel.pump()
+	}
+}
+
+// drop drops msg, telling the sender if policy is OverflowError.
+func (localChannel *LocalChannel) drop(msg Message, policy OverflowPolicy) {
+	localChannel.mailbox.dropped.Add(1)
+	if policy == OverflowError {
+		localChannel.localNode.post(msg.From, encodeOverflow(localChannel.channelID))
+	}
+}
+
+func (localChannel *LocalChannel) tryQueue(msg Message) bool {
+	select {
+	case localChannel.Queue <- msg:
+		localChannel.mailbox.delivered.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+// pump moves the backlog to the Queue as the consumer makes room, until the
+// backlog is empty or the channel closes.
+func (localChannel *LocalChannel) pump() {
+	gate := localChannel.queueGate
+	gate.RLock()
+	defer gate.RUnlock()
+
+	box := localChannel.mailbox
+	for {
+		box.Lock()
+		if gate.closed || len(box.backlog) == 0 {
+			box.backlog = nil
+			box.Unlock()
+			return
+		}
+		msg := box.backlog[0]
+		box.Unlock()
+
+		select {
+		case localChannel.Queue <- msg:
+			box.delivered.Add(1)
+		case <-gate.done:
+			box.Lock()
+			box.backlog = nil
+			box.Unlock()
+			return
+		}
+
+		box.Lock()
+		box.backlog[0] = Message{}
+		box.backlog = box.backlog[1:]
+		box.Unlock()
+	}
+}
+
+func encodeOverflow(chanID ChannelID) []byte {
+	msg := make([]byte, 9)
+	msg[0] = ctrlOverflow
+	binary.BigEndian.PutUint64(msg[1:], uint64(chanID))
+	return msg
+}
+
+// overflowed records that a remote channel dropped a message of our channel
+// chanID, for the next send to it to fail.
+func (node *LocalNode) overflowed(ident Identifier, chanID ChannelID) {
+	from, ok := ident.(EndPointAddress)
+	if !ok {
+		return
+	}
+	st := &node.localState
+	st.Lock()
+	defer st.Unlock()
+
+	if vst, ok := st.value.(*LocalNodeValid); ok && vst._1.localSwitches[chanID] != nil {
+		vst._1.localOverflowed[ChannelRef{from, chanID}] = struct{}{}
+	}
+}
@@ -0,0 +1,187 @@
+package tcp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PeerEventKind tells what happened between a channel and a peer.
+type PeerEventKind uint8
+
+const (
+	// The first connection from the peer to the channel opened
+	PeerConnected PeerEventKind = iota
+	// The last connection from the peer to the channel closed
+	PeerDisconnected
+	// The connections to the peer's endpoint broke
+	PeerLost
+)
+
+func (kind PeerEventKind) String() string {
+	switch kind {
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerLost:
+		return "lost"
+	}
+	return fmt.Sprintf("PeerEventKind(%d)", uint8(kind))
+}
+
+// PeerEvent is a change in the peers connected to a channel.
+type PeerEvent struct {
+	Peer EndPointAddress
+	Kind PeerEventKind
+}
+
+// Peers counts the incoming connections of a LocalChannel by peer, and tells
+// when a peer comes and goes.
+type Peers struct {
+	sync.Mutex
+	count        map[EndPointAddress]int
+	onDisconnect func(EndPointAddress, DiedReason)
+	events       chan PeerEvent // nil until PeerEvents is called
+	backlog      []PeerEvent    // events the pump has yet to deliver
+	wake         chan struct{}
+	closed       bool
+	done         chan struct{} // closed with the channel, to stop the pump
+}
+
+func newPeers() *Peers {
+	return &Peers{
+		count: make(map[EndPointAddress]int),
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// OnDisconnect calls f, on the goroutine that handles the messages of the
+// node, when the last connection from a peer to localChannel closes
+// (DiedNormal) or breaks (DiedDisconnect). Like onConnect, f must not block.
+func OnDisconnect(localChannel *LocalChannel, f func(EndPointAddress, DiedReason)) {
+	peers := localChannel.peers
+	peers.Lock()
+	defer peers.Unlock()
+	peers.onDisconnect = f
+}
+
+// PeerEvents returns the peer events of localChannel from now on, in order.
+// Events are buffered until they are read. Once localChannel is closed the
+// channel is closed too, and the events not read by then are dropped.
+func PeerEvents(localChannel *LocalChannel) <-chan PeerEvent {
+	peers := localChannel.peers
+	peers.Lock()
+	defer peers.Unlock()
+
+	if peers.events == nil {
+		peers.events = make(chan PeerEvent)
+		if peers.closed {
+			close(peers.events)
+		} else {
+			go peers.pump()
+		}
+	}
+	return peers.events
+}
+
+func (peers *Peers) connected(peer EndPointAddress) {
+	peers.Lock()
+	defer peers.Unlock()
+
+	peers.count[peer]++
+	if peers.count[peer] == 1 {
+		peers.emit(PeerEvent{peer, PeerConnected})
+	}
+}
+
+func (peers *Peers) disconnected(peer EndPointAddress) {
+	peers.gone(peer, false)
+}
+
+// lost forgets every connection from peer at once.
+func (peers *Peers) lost(peer EndPointAddress) {
+	peers.gone(peer, true)
+}
+
+func (peers *Peers) gone(peer EndPointAddress, lost bool) {
+	var f func(EndPointAddress, DiedReason)
+	func() {
+		peers.Lock()
+		defer peers.Unlock()
+
+		n, ok := peers.count[peer]
+		if !ok {
+			return
+		}
+		if !lost && n > 1 {
+			peers.count[peer] = n - 1
+			return
+		}
+		delete(peers.count, peer)
+		if lost {
+			peers.emit(PeerEvent{peer, PeerLost})
+		} else {
+			peers.emit(PeerEvent{peer, PeerDisconnected})
+		}
+		f = peers.onDisconnect
+	}()
+	if f == nil {
+		return
+	}
+	if lost {
+		f(peer, DiedDisconnect{})
+	} else {
+		f(peer, DiedNormal{})
+	}
+}
+
+// emit queues an event for the pump; the caller holds the lock.
+func (peers *Peers) emit(event PeerEvent) {
+	if peers.events == nil || peers.closed {
+		return
+	}
+	peers.backlog = append(peers.backlog, event)
+	select {
+	case peers.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close ends the events, whether those queued are read or not.
+func (peers *Peers) close() {
+	peers.Lock()
+	defer peers.Unlock()
+
+	if peers.closed {
+		return
+	}
+	peers.closed = true
+	peers.backlog = nil
+	close(peers.done)
+}
+
+// pump hands the backlog to the reader of events, so that the goroutine
+// handling node messages never waits for it.
+func (peers *Peers) pump() {
+	defer close(peers.events)
+	for {
+		select {
+		case <-peers.wake:
+		case <-peers.done:
+			return
+		}
+		peers.Lock()
+		backlog := peers.backlog
+		peers.backlog = nil
+		peers.Unlock()
+
+		for _, event := range backlog {
+			select {
+			case peers.events <- event:
+			case <-peers.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+A node keeps the connection of each of its channels to each remote endpoint
+for as long as it works. The connections to an endpoint are dropped when the
+node loses it, and when a send on one of them fails; the next send dials
+again. A send tries as many times as the redial policy of the node says,
+waiting longer between tries each time, before it fails with ErrUnreachable;
+a remote channel that is not found or refuses is not tried again.
+*/
+
+// ErrUnreachable is the error of a send that could not get through after
+// every attempt.
+var ErrUnreachable = errors.New("remote endpoint unreachable")
+
+// RedialOption adjusts how a node re-dials, see SetRedial.
+type RedialOption func(*Redial)
+
+// WithRedialAttempts sets how many times a send or a dial is tried.
+func WithRedialAttempts(n int) RedialOption {
+	return func(r *Redial) {
+		r.attempts = n
+	}
+}
+
+// WithRedialBackoff sets the wait before the second attempt, which doubles
+// for every attempt after it up to max.
+func WithRedialBackoff(backoff, max time.Duration) RedialOption {
+	return func(r *Redial) {
+		r.backoff = backoff
+		r.maxBackoff = max
+	}
+}
+
+// Redial is the redial policy of a node.
+type Redial struct {
+	sync.Mutex
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRedial() *Redial {
+	return &Redial{
+		attempts:   3,
+		backoff:    50 * time.Millisecond,
+		maxBackoff: time.Second,
+	}
+}
+
+// SetRedial changes the redial policy of node. By default a send is tried
+// three times, 50ms apart and then 100ms.
+func SetRedial(node *LocalNode, opts ...RedialOption) {
+	r := node.localRedial
+	r.Lock()
+	defer r.Unlock()
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.attempts < 1 {
+		r.attempts = 1
+	}
+}
+
+// withConnection runs f on the connection of channel from to the endpoint
+// to, dialing it when there is none, and tries again with a new one when
+// either fails.
+func (node *LocalNode) withConnection(from ChannelID, to EndPointAddress, f func(*Connection) error) error {
+	r := node.localRedial
+	r.Lock()
+	attempts, backoff, maxBackoff := r.attempts, r.backoff, r.maxBackoff
+	r.Unlock()
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-node.localLife.done:
+				return ErrLocalNodeClosed
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+		var conn *Connection
+		conn, err = connBetween(node, from, to)
+		if errors.Is(err, ErrChannelNotFound) || errors.Is(err, ErrChannelRefused) {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+		if err = f(conn); err == nil {
+			return nil
+		}
+		node.dropLocalConnection(from, to, conn)
+	}
+	return fmt.Errorf("%w: %v after %d attempts: %w", ErrUnreachable, to, attempts, err)
+}
+
+// send sends payload on the connection of channel from to the endpoint to.
+func (node *LocalNode) send(from ChannelID, to EndPointAddress, payload []byte) error {
+	return node.withConnection(from, to, func(conn *Connection) error {
+		_, err := conn.Send(payload)
+		return err
+	})
+}
+
+// connect makes sure channel from has a connection to the endpoint to.
+func (node *LocalNode) connect(from ChannelID, to EndPointAddress) error {
+	return node.withConnection(from, to, func(*Connection) error {
+		return nil
+	})
+}
@@ -0,0 +1,333 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+Every transport runs a registry on the system endpoint RegistryEndPointId. It
+answers lookups of the names registered on the transport, and asks the
+registries of other transports on behalf of Lookup. Registries talk over
+ordinary lightweight connections, one from each registry to each peer it has
+asked or answered:
+
+	lookupRequest  req name           what is name registered as?
+	lookupReply    req found epid     found is 0 for an unknown name
+
+req is a uint64 picked by the asking registry, epid a uint32.
+*/
+const (
+	lookupRequest uint8 = iota
+	lookupReply
+)
+
+// ConnectError is a failure to find or reach an endpoint.
+type ConnectError struct {
+	Code ConnectErrorCode
+	Msg  string
+}
+
+func (e *ConnectError) Error() string {
+	return e.Code.String() + ": " + e.Msg
+}
+
+func errNameNotFound(name string) error {
+	return &ConnectError{ConnectNotFound{}, fmt.Sprintf("no endpoint registered as %q", name)}
+}
+
+//------------------------------------------------------------------------------
+// Local names                                                                --
+//------------------------------------------------------------------------------
+
+// | Register a name for a local endpoint
+func (tp *TCPTransport) apiRegister(name string, ep *EndPoint) error {
+	addr := ep.Address()
+	if addr.TransportAddr != tp.transportAddr {
+		return fmt.Errorf("register %q: %v is not an endpoint of this transport", name, addr)
+	}
+
+	tpState := &tp.transportState
+	tpState.Lock()
+	defer tpState.Unlock()
+
+	switch st := tpState.value.(type) {
+	case *TransPortValid:
+		vst := &st._1
+		if _, ok := vst._localEndPoints[addr.EndPointId]; !ok {
+			return ErrEndPointClosed
+		}
+		if epid, ok := vst._registeredNames[name]; ok {
+			return fmt.Errorf("register %q: already registered for endpoint %d", name, epid)
+		}
+		vst._registeredNames[name] = addr.EndPointId
+		return nil
+	}
+	return ErrTransportClosed
+}
+
+// | Remove a registered name
+func (tp *TCPTransport) apiUnregister(name string) error {
+	tpState := &tp.transportState
+	tpState.Lock()
+	defer tpState.Unlock()
+
+	switch st := tpState.value.(type) {
+	case *TransPortValid:
+		if _, ok := st._1._registeredNames[name]; !ok {
+			return errNameNotFound(name)
+		}
+		delete(st._1._registeredNames, name)
+		return nil
+	}
+	return ErrTransportClosed
+}
+
+// whereis finds a name registered on this transport.
+func (tp *TCPTransport) whereis(name string) (EndPointAddress, error) {
+	tpState := &tp.transportState
+	tpState.Lock()
+	defer tpState.Unlock()
+
+	switch st := tpState.value.(type) {
+	case *TransPortValid:
+		if epid, ok := st._1._registeredNames[name]; ok {
+			return EndPointAddress{tp.transportAddr, epid}, nil
+		}
+		return EndPointAddress{}, errNameNotFound(name)
+	}
+	return EndPointAddress{}, ErrTransportClosed
+}
+
+// forgetNames drops the names of an endpoint that is going away.
+func (vst *ValidTransportState) forgetNames(epid EndPointId) {
+	for name, id := range vst._registeredNames {
+		if id == epid {
+			delete(vst._registeredNames, name)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// Registry endpoint                                                          --
+//------------------------------------------------------------------------------
+
+// Registry serves the names of a transport to its peers, and looks up theirs.
+type Registry struct {
+	tp *TCPTransport
+	ep *EndPoint
+
+	sync.Mutex
+	nextRequest uint64
+	pending     map[uint64]*pendingLookup
+	conns       map[EndPointAddress]*Connection  // ours, to other registries
+	peers       map[ConnectionId]EndPointAddress // theirs, to us
+}
+
+type pendingLookup struct {
+	addr  TransportAddr
+	name  string
+	reply chan lookupResult // buffered, the first result wins
+}
+
+func (p *pendingLookup) deliver(res lookupResult) {
+	select {
+	case p.reply <- res:
+	default:
+	}
+}
+
+type lookupResult struct {
+	addr EndPointAddress
+	err  error
+}
+
+// startRegistry creates the system endpoint and starts serving lookups.
+func (tp *TCPTransport) startRegistry() error {
+	ep, err := tp.apiNewEndPoint(RegistryEndPointId, nil)
+	if err != nil {
+		return err
+	}
+	r := &Registry{
+		tp:      tp,
+		ep:      ep,
+		pending: make(map[uint64]*pendingLookup),
+		conns:   make(map[EndPointAddress]*Connection),
+		peers:   make(map[ConnectionId]EndPointAddress),
+	}
+	tp.transportRegistry = r
+	go r.serve()
+	return nil
+}
+
+// | Find the endpoint registered as name on the transport at addr
+func (r *Registry) lookup(ctx context.Context, addr TransportAddr, name string) (EndPointAddress, error) {
+	if addr == r.tp.transportAddr {
+		return r.tp.whereis(name)
+	}
+
+	p := &pendingLookup{addr, name, make(chan lookupResult, 1)}
+	r.Lock()
+	r.nextRequest++
+	req := r.nextRequest
+	r.pending[req] = p
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.pending, req)
+		r.Unlock()
+	}()
+
+	msg := make([]byte, 9, 9+len(name))
+	msg[0] = lookupRequest
+	binary.BigEndian.PutUint64(msg[1:], req)
+	msg = append(msg, name...)
+	if err := r.send(EndPointAddress{addr, RegistryEndPointId}, msg); err != nil {
+		return EndPointAddress{}, err
+	}
+	select {
+	case res := <-p.reply:
+		return res.addr, res.err
+	case <-ctx.Done():
+		return EndPointAddress{}, ctx.Err()
+	}
+}
+
+// send sends msg to another registry, dialing it if we have no connection
+// yet, and once more if the connection we had is broken.
+func (r *Registry) send(to EndPointAddress, msg []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *Connection
+		conn, err = r.connTo(to)
+		if err != nil {
+			return err
+		}
+		if _, err = conn.Send(msg); err == nil {
+			return nil
+		}
+		r.dropConn(to, conn)
+	}
+	return err
+}
+
+func (r *Registry) connTo(to EndPointAddress) (*Connection, error) {
+	r.Lock()
+	conn, ok := r.conns[to]
+	r.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	conn, err := r.ep.Dial(to)
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if other, ok := r.conns[to]; ok {
+		// somebody else dialed meanwhile
+		go conn.Close()
+		return other, nil
+	}
+	r.conns[to] = conn
+	return conn, nil
+}
+
+func (r *Registry) dropConn(to EndPointAddress, conn *Connection) {
+	r.Lock()
+	if r.conns[to] == conn {
+		delete(r.conns, to)
+	}
+	r.Unlock()
+	conn.Close()
+}
+
+func (r *Registry) serve() {
+	for {
+		switch e := r.ep.Receive().(type) {
+		case *ConnectionOpened:
+			r.Lock()
+			r.peers[e._1] = e._2
+			r.Unlock()
+		case *ConnectionClosed:
+			r.Lock()
+			delete(r.peers, e._1)
+			r.Unlock()
+		case *Received:
+			r.received(e._1, e._2)
+			e.Release()
+		case *ErrorEvent:
+			if lost, ok := e._1.(*EventConnectionLost); ok {
+				r.lost(lost._1)
+			}
+		case EndPointClosed:
+			return
+		}
+	}
+}
+
+func (r *Registry) received(connId ConnectionId, msg []byte) {
+	if len(msg) < 9 {
+		return
+	}
+	req := binary.BigEndian.Uint64(msg[1:9])
+	switch msg[0] {
+	case lookupRequest:
+		r.Lock()
+		from, ok := r.peers[connId]
+		r.Unlock()
+		if !ok {
+			return
+		}
+		reply := make([]byte, 14)
+		reply[0] = lookupReply
+		binary.BigEndian.PutUint64(reply[1:], req)
+		if addr, err := r.tp.whereis(string(msg[9:])); err == nil {
+			reply[9] = 1
+			binary.BigEndian.PutUint32(reply[10:], uint32(addr.EndPointId))
+		}
+		// dialing back may take a while; keep serving meanwhile
+		go r.send(from, reply)
+	case lookupReply:
+		if len(msg) < 14 {
+			return
+		}
+		r.Lock()
+		p, ok := r.pending[req]
+		r.Unlock()
+		if !ok {
+			return
+		}
+		res := lookupResult{err: errNameNotFound(p.name)}
+		if msg[9] == 1 {
+			res = lookupResult{addr: EndPointAddress{p.addr, EndPointId(binary.BigEndian.Uint32(msg[10:]))}}
+		}
+		p.deliver(res)
+	}
+}
+
+// lost forgets the connections to a registry whose socket broke, and fails
+// the lookups waiting for it.
+func (r *Registry) lost(addr EndPointAddress) {
+	r.Lock()
+	defer r.Unlock()
+
+	if conn, ok := r.conns[addr]; ok {
+		delete(r.conns, addr)
+		go conn.Close()
+	}
+	for connId, peer := range r.peers {
+		if peer == addr {
+			delete(r.peers, connId)
+		}
+	}
+	for _, p := range r.pending {
+		if p.addr == addr.TransportAddr {
+			p.deliver(lookupResult{err: errors.New("registry connection lost")})
+		}
+	}
+}
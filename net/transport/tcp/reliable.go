@@ -0,0 +1,475 @@
+package tcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+A reliable connection is a session that outlives the lightweight connections,
+and the sockets, carrying it. The sender numbers the messages of the session
+1, 2, ... and keeps the ones the peer has not acknowledged. Every lightweight
+connection of the session starts with
+
+	SessionOpen lcid session first   lcid carries session, from message first on
+
+after which the peer acknowledges it (see acks.go) with the number of session
+messages it has delivered, whichever socket they came on. When the socket is
+lost the sender dials again and replays everything after the last
+acknowledged message; the receiver remembers how far every session got and
+drops what it already delivered. A connection that would start past the next
+message to deliver, as it does after the receiver forgot the session, fails
+its socket instead. Between replay and de-duplication every message is
+delivered once and in order, for as long as the connection lives; what was
+not acknowledged when it fails may or may not have been delivered.
+
+The receiver may not have noticed that the old socket is gone, and would take
+a dial on its stripe for a crossed request. A reconnect therefore dials on the
+stripes after the configured ones, up to maxStripes, a different one every
+time, and the receiver drops the socket a session was on once the session
+resumes on another one. The spare stripes are used in turn, so a stripe comes
+back only after maxStripes - tcpStripes reconnects, when the socket it last
+carried has long been dropped. A transport configured with maxStripes stripes
+has no spare ones and reconnects on its own stripes.
+
+Closing the connection ends the session on both sides. A session whose sender
+goes away for good is remembered until the receiving endpoint closes.
+*/
+
+var (
+	errStreamUnreliable = errors.New("streams are not resent; use a plain connection")
+	errStaleSocket      = errors.New("a session moved to another socket; socket is stale")
+	errSessionGap       = errors.New("reliable session resumed past the messages delivered")
+)
+
+//------------------------------------------------------------------------------
+// Sending                                                                    --
+//------------------------------------------------------------------------------
+
+type reliableSession struct {
+	ourEndPoint  *LocalEndPoint
+	params       *TCPParameters
+	theirAddress EndPointAddress
+	id           uint64
+
+	mtx     sync.Mutex
+	sending sync.Mutex    // taken under mtx, in the order messages are numbered
+	changed chan struct{} // closed and replaced whenever acked, closed or err change
+	pending [][]byte      // messages acked+1 .. sent
+	acked   uint64
+	sent    uint64
+	conn    *sessionConn // nil while reconnecting
+	closed  bool
+	err     error         // why the session failed for good
+	stop    chan struct{} // closed by Close, cuts reconnecting short
+
+	redials uint32 // dials since the first, only touched by reconnect
+}
+
+// sessionConn is the lightweight connection currently carrying a session.
+type sessionConn struct {
+	theirEndPoint *RemoteEndPoint
+	connId        LightweightConnectionId
+	connAlive     *AtomicBool
+	acks          *Acks
+}
+
+// | Connect to an endpoint with a connection that resends what a lost socket
+// did not deliver
+func (params *TCPParameters) apiConnectReliable(ourEndPoint *LocalEndPoint, theirAddress EndPointAddress) (*Connection, error) {
+	s := &reliableSession{
+		ourEndPoint:  ourEndPoint,
+		params:       params,
+		theirAddress: theirAddress,
+		id:           newSessionId(),
+		changed:      make(chan struct{}),
+		stop:         make(chan struct{}),
+	}
+	c, err := s.dial(false)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	s.resume(c)
+	s.mtx.Unlock()
+
+	return &Connection{
+		Close: s.close,
+		Send: func(msg []byte) (int, error) {
+			if _, err := s.enqueue(msg); err != nil {
+				return 0, err
+			}
+			return len(msg), nil
+		},
+		SendSync: s.sendSync,
+		Outstanding: func() int {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+
+			return int(s.sent - s.acked)
+		},
+		SendStream: func(io.Reader) (int64, error) {
+			return 0, errStreamUnreliable
+		},
+	}, nil
+}
+
+// newSessionId picks a random session id, so that a restarted peer with the
+// same address does not resume the sessions of its previous life.
+func newSessionId() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// dial connects to the peer. A redial uses the stripes after the configured
+// ones, in turn, wrapping around at maxStripes (see above).
+func (s *reliableSession) dial(redial bool) (*sessionConn, error) {
+	stripe := s.ourEndPoint.nextStripe(s.params.tcpStripes)
+	if spare := maxStripes - s.params.tcpStripes; redial && spare > 0 {
+		stripe = s.params.tcpStripes + s.redials%spare
+		s.redials++
+	}
+	key := SocketKey{s.theirAddress, stripe}
+	if err := s.ourEndPoint.resetIfBroken(key); err != nil {
+		return nil, err
+	}
+	theirEndPoint, connId, err := s.params.createConnectionTo(s.ourEndPoint, key)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionConn{theirEndPoint: theirEndPoint, connId: connId, connAlive: NewBool(true)}, nil
+}
+
+// resume makes c carry the session: it tells the peer where c starts and
+// replays everything the peer has not acknowledged. Called with s.mtx held.
+func (s *reliableSession) resume(c *sessionConn) {
+	c.acks = resumeAcks(s.acked)
+	c.acks.ask()
+	c.theirEndPoint.remoteAcks.add(c.connId, c.acks)
+
+	first := s.acked + 1
+	c.theirEndPoint.sendOnConnection(c.connAlive, func(vst *ValidRemoteEndPointState) {
+		vst.sendControl(c.connId, func(w io.Writer) {
+			sendSessionOpen(uint32(c.connId), s.id, first, w)
+		})
+	})
+	// a failure shows up in c.acks, and watch takes it from there
+	s.sending.Lock()
+	for _, msg := range s.pending {
+		s.ourEndPoint.apiSend(c.theirEndPoint, c.connId, msg, c.connAlive, c.acks)
+	}
+	s.sending.Unlock()
+	s.conn = c
+	go s.watch(c, s.acked)
+}
+
+// watch follows the acknowledgements on c until its socket is lost, then
+// carries the session over to a new one.
+func (s *reliableSession) watch(c *sessionConn, acked uint64) {
+	for {
+		n, err := c.acks.advanced(acked)
+		if err != nil {
+			break
+		}
+		acked = n
+
+		s.mtx.Lock()
+		s.acknowledge(n)
+		s.mtx.Unlock()
+	}
+	s.reconnect(c)
+}
+
+// acknowledge drops the messages the peer has delivered. Called with s.mtx
+// held.
+func (s *reliableSession) acknowledge(n uint64) {
+	if n <= s.acked {
+		return
+	}
+	done := int(n - s.acked)
+	if done > len(s.pending) {
+		done = len(s.pending)
+	}
+	for i := 0; i < done; i++ {
+		s.pending[i] = nil
+	}
+	s.pending = s.pending[done:]
+	s.acked = n
+	s.broadcast()
+}
+
+// reconnect dials the peer again, backing off between attempts, until it
+// succeeds, the session is closed or tcpReconnectTimeout has passed.
+func (s *reliableSession) reconnect(lost *sessionConn) {
+	s.mtx.Lock()
+	if s.closed || s.conn != lost {
+		s.mtx.Unlock()
+		return
+	}
+	s.conn = nil
+	s.mtx.Unlock()
+	lost.theirEndPoint.remoteAcks.remove(lost.connId)
+
+	deadline := time.Now().Add(s.params.tcpReconnectTimeout)
+	backoff := 10 * time.Millisecond
+	for {
+		c, err := s.dial(true)
+
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			if c != nil {
+				s.ourEndPoint.apiClose(c.theirEndPoint, c.connId, c.connAlive)
+			}
+			return
+		}
+		if err == nil {
+			s.resume(c)
+			s.mtx.Unlock()
+			return
+		}
+		if err == ErrEndPointClosed || time.Now().After(deadline) {
+			s.err = err
+			s.broadcast()
+			s.mtx.Unlock()
+			return
+		}
+		s.mtx.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+		}
+		if backoff < time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// enqueue numbers msg, keeps it until it is acknowledged and sends it if the
+// session has a connection. It waits while the retransmit buffer is full.
+//
+// The send may block on a full send queue, so it happens after s.mtx is
+// released; s.sending, taken before, keeps the messages in order.
+func (s *reliableSession) enqueue(msg []byte) (uint64, error) {
+	s.mtx.Lock()
+	err := s.await(context.Background(), func() bool {
+		return s.sent-s.acked < uint64(s.params.tcpRetransmitBuffer)
+	})
+	if err == nil {
+		err = s.failure()
+	}
+	if err != nil {
+		s.mtx.Unlock()
+		return 0, err
+	}
+	s.sent++
+	seq, c := s.sent, s.conn
+	s.pending = append(s.pending, msg)
+	s.sending.Lock()
+	s.mtx.Unlock()
+
+	defer s.sending.Unlock()
+	if c != nil {
+		s.ourEndPoint.apiSend(c.theirEndPoint, c.connId, msg, c.connAlive, c.acks)
+	}
+	return seq, nil
+}
+
+func (s *reliableSession) sendSync(ctx context.Context, msg []byte) error {
+	seq, err := s.enqueue(msg)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.await(ctx, func() bool { return s.acked >= seq })
+}
+
+// close waits, up to tcpCloseTimeout, for the peer to acknowledge everything
+// and then ends the session.
+func (s *reliableSession) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.params.tcpCloseTimeout)
+	defer cancel()
+
+	s.mtx.Lock()
+	s.await(ctx, func() bool { return s.acked == s.sent })
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.broadcast()
+	c := s.conn
+	s.conn, s.pending = nil, nil
+	s.mtx.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	c.theirEndPoint.remoteAcks.remove(c.connId)
+	c.acks.fail(ErrConnectionClosed)
+	return s.ourEndPoint.apiClose(c.theirEndPoint, c.connId, c.connAlive)
+}
+
+func (s *reliableSession) failure() error {
+	if s.closed {
+		return ErrConnectionClosed
+	}
+	return s.err
+}
+
+func (s *reliableSession) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// await waits until ready returns true, the session ends or ctx is done.
+// Called with s.mtx held, which it releases while waiting.
+func (s *reliableSession) await(ctx context.Context, ready func() bool) error {
+	for {
+		if ready() {
+			return nil
+		}
+		if err := s.failure(); err != nil {
+			return err
+		}
+		changed := s.changed
+		s.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.mtx.Lock()
+			return ctx.Err()
+		}
+		s.mtx.Lock()
+	}
+}
+
+//------------------------------------------------------------------------------
+// Receiving                                                                  --
+//------------------------------------------------------------------------------
+
+// InboundSessions remembers how far every reliable session sent to a local
+// endpoint got, so that messages resent on a new socket are delivered once.
+type InboundSessions struct {
+	sync.Mutex
+	sessions map[sessionKey]*inboundSession
+}
+
+type sessionKey struct {
+	peer EndPointAddress
+	id   uint64
+}
+
+type inboundSession struct {
+	sync.Mutex
+	delivered uint64
+	carrier   *RemoteEndPoint // the socket the session was last opened on
+}
+
+func newInboundSessions() *InboundSessions {
+	return &InboundSessions{sessions: make(map[sessionKey]*inboundSession)}
+}
+
+// open finds (or starts) a session for a lightweight connection on
+// theirEndPoint whose first message is message first of the session. A
+// session that was on another socket before leaves that one stale.
+func (is *InboundSessions) open(ourEndPoint *LocalEndPoint, theirEndPoint *RemoteEndPoint, id uint64, first uint64) *sessionCursor {
+	is.Lock()
+	key := sessionKey{theirEndPoint.remoteAddress, id}
+	session, ok := is.sessions[key]
+	if !ok {
+		session = &inboundSession{}
+		is.sessions[key] = session
+	}
+	is.Unlock()
+
+	session.Lock()
+	stale := session.carrier
+	session.carrier = theirEndPoint
+	session.Unlock()
+	if stale != nil && stale != theirEndPoint {
+		ourEndPoint.dropStale(stale)
+	}
+	return &sessionCursor{key: key, session: session, next: first}
+}
+
+// dropStale gives up on a socket that is still valid although the peer
+// resumed a session elsewhere: the peer lost it without us noticing.
+func (ourEndPoint *LocalEndPoint) dropStale(theirEndPoint *RemoteEndPoint) {
+	sock := func() net.Conn {
+		theirState := &theirEndPoint.remoteState
+		theirState.Lock()
+		defer theirState.Unlock()
+
+		// as prematureExit does for a valid endpoint
+		if st, ok := theirState.value.(*RemoteEndPointValid); ok {
+			code := &EventConnectionLost{theirEndPoint.remoteAddress}
+			ourEndPoint.enqueue(&ErrorEvent{code, errStaleSocket})
+			theirState.value = &RemoteEndPointFailed{errStaleSocket}
+			return st._1.remoteConn
+		}
+		return nil
+	}()
+	// the reader of the stale socket exits and cleans up
+	if sock != nil {
+		tryShutdownSocketBoth(sock)
+	}
+}
+
+func (is *InboundSessions) remove(key sessionKey) {
+	is.Lock()
+	defer is.Unlock()
+
+	delete(is.sessions, key)
+}
+
+// sessionCursor is where an incoming lightweight connection is in its
+// session. Only the socket reader of the connection touches it.
+type sessionCursor struct {
+	key     sessionKey
+	session *inboundSession
+	next    uint64 // number of the next message on the connection
+}
+
+// deliver hands msg to enqueue unless the session already delivered it on
+// another socket, and returns how many messages the session has delivered.
+// A message past the next one to deliver is errSessionGap.
+func (cur *sessionCursor) deliver(msg []byte, enqueue func([]byte)) (uint64, error) {
+	session := cur.session
+	session.Lock()
+	defer session.Unlock()
+
+	seq := cur.next
+	cur.next++
+	switch {
+	case seq == session.delivered+1:
+		enqueue(msg)
+		session.delivered = seq
+	case seq > session.delivered+1:
+		putBuffer(msg)
+		return session.delivered, errSessionGap
+	default:
+		putBuffer(msg)
+	}
+	return session.delivered, nil
+}
+
+func (cur *sessionCursor) delivered() uint64 {
+	cur.session.Lock()
+	defer cur.session.Unlock()
+
+	return cur.session.delivered
+}
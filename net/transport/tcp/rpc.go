@@ -0,0 +1,286 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+A call is a request to a channel of some node that gets a response. Calls
+travel between the RPC services of nodes, on the reserved channel
+rpcChannelID, and are served by the handler the owner of the target channel
+gave to HandleCalls:
+
+	request  id channel deadline request   deadline is 0 for none
+	cancel   id                            the caller gave up
+	reply    id code response              response is the error message
+	                                       unless code is callOK
+
+id is a uint64 picked by the caller, channel a uint64, deadline an int64 of
+unix nanoseconds and code a uint8 CallErrorCode. The deadline is the caller's
+clock; nodes are expected to keep theirs in sync.
+*/
+
+const (
+	rpcRequest uint8 = iota
+	rpcCancel
+	rpcReply
+)
+
+// CallErrorCode tells why a call failed on the callee's side.
+type CallErrorCode uint8
+
+const (
+	callOK CallErrorCode = iota
+	// The handler returned an error
+	CallHandlerFailed
+	// No channel serves calls under the id called
+	CallNoSuchChannel
+)
+
+func (code CallErrorCode) String() string {
+	switch code {
+	case callOK:
+		return "ok"
+	case CallHandlerFailed:
+		return "handler failed"
+	case CallNoSuchChannel:
+		return "no such channel"
+	}
+	return fmt.Sprintf("CallErrorCode(%d)", uint8(code))
+}
+
+// CallError is a call that failed on the callee's side.
+type CallError struct {
+	Code CallErrorCode
+	Msg  string
+}
+
+func (e *CallError) Error() string {
+	return e.Code.String() + ": " + e.Msg
+}
+
+// Handler serves the calls to a channel. ctx is done when the caller gives up
+// or its deadline passes.
+type Handler func(ctx context.Context, from EndPointAddress, request []byte) ([]byte, error)
+
+// RPC makes and serves the calls of a node.
+type RPC struct {
+	node    *LocalNode
+	channel *LocalChannel
+
+	sync.Mutex
+	nextCall uint64
+	pending  map[uint64]pendingCall // calls made, by id
+	handlers map[ChannelID]Handler
+	serving  map[servingKey]context.CancelFunc // calls being served
+}
+
+type servingKey struct {
+	from EndPointAddress
+	id   uint64
+}
+
+type pendingCall struct {
+	to    EndPointAddress
+	reply chan callReply
+}
+
+type callReply struct {
+	code     CallErrorCode
+	response []byte
+	err      error // the call failed on our side
+}
+
+// startRPC opens the RPC channel and starts serving calls.
+func (node *LocalNode) startRPC() error {
+	channel, err := newLocalChannel(node, rpcChannelID, nil)
+	if err != nil {
+		return err
+	}
+	r := &RPC{
+		node:     node,
+		channel:  channel,
+		pending:  make(map[uint64]pendingCall),
+		handlers: make(map[ChannelID]Handler),
+		serving:  make(map[servingKey]context.CancelFunc),
+	}
+	node.localRPC = r
+	go r.serve()
+	return nil
+}
+
+// HandleCalls serves the calls to localChannel with handler, in a goroutine
+// per call. A nil handler stops serving them.
+func HandleCalls(localChannel *LocalChannel, handler Handler) {
+	r := localChannel.localNode.localRPC
+	r.Lock()
+	defer r.Unlock()
+
+	if handler == nil {
+		delete(r.handlers, localChannel.channelID)
+		return
+	}
+	r.handlers[localChannel.channelID] = handler
+}
+
+// Call sends request to the channel chanID of the node at to and waits for
+// the response. The deadline of ctx holds for the handler too, and the
+// handler's context is cancelled when ctx is done first. A failure on the
+// callee's side is a *CallError. The call fails too when the connection to
+// the callee is lost.
+func (node *LocalNode) Call(ctx context.Context, to EndPointAddress, chanID ChannelID, request []byte) ([]byte, error) {
+	r := node.localRPC
+	reply := make(chan callReply, 1)
+	r.Lock()
+	r.nextCall++
+	id := r.nextCall
+	r.pending[id] = pendingCall{to, reply}
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.pending, id)
+		r.Unlock()
+	}()
+
+	var deadline int64
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.UnixNano()
+	}
+	if err := SendPayload(r.channel, to, encodeCallRequest(id, chanID, deadline, request)); err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-reply:
+		if res.err != nil {
+			return nil, res.err
+		}
+		if res.code != callOK {
+			return nil, &CallError{res.code, string(res.response)}
+		}
+		return res.response, nil
+	case <-ctx.Done():
+		msg := make([]byte, 9)
+		msg[0] = rpcCancel
+		binary.BigEndian.PutUint64(msg[1:], id)
+		SendPayload(r.channel, to, msg)
+		return nil, ctx.Err()
+	}
+}
+
+func (r *RPC) serve() {
+	for msg := range r.channel.Queue {
+		r.received(msg.From, msg.Payload)
+	}
+}
+
+func (r *RPC) received(from EndPointAddress, msg []byte) {
+	if len(msg) < 9 {
+		return
+	}
+	id := binary.BigEndian.Uint64(msg[1:9])
+	switch msg[0] {
+	case rpcRequest:
+		if len(msg) < 25 {
+			return
+		}
+		chanID := ChannelID(binary.BigEndian.Uint64(msg[9:]))
+		deadline := int64(binary.BigEndian.Uint64(msg[17:]))
+		r.serveCall(from, id, chanID, deadline, msg[25:])
+	case rpcCancel:
+		r.Lock()
+		cancel, ok := r.serving[servingKey{from, id}]
+		r.Unlock()
+		if ok {
+			cancel()
+		}
+	case rpcReply:
+		if len(msg) < 10 {
+			return
+		}
+		r.Lock()
+		call, ok := r.pending[id]
+		r.Unlock()
+		if ok && call.to == from {
+			call.done(callReply{CallErrorCode(msg[9]), msg[10:], nil})
+		}
+	}
+}
+
+func (call pendingCall) done(res callReply) {
+	select {
+	case call.reply <- res:
+	default:
+	}
+}
+
+// failCalls fails the calls made to a node we lost.
+func (r *RPC) failCalls(addr EndPointAddress, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, call := range r.pending {
+		if call.to == addr {
+			call.done(callReply{err: err})
+		}
+	}
+}
+
+func (r *RPC) serveCall(from EndPointAddress, id uint64, chanID ChannelID, deadline int64, request []byte) {
+	r.Lock()
+	handler, ok := r.handlers[chanID]
+	r.Unlock()
+	if !ok || r.node.getLocalChannel(chanID) == nil {
+		msg := fmt.Sprintf("channel %d serves no calls", chanID)
+		// replying may dial; keep serving meanwhile
+		go r.reply(from, id, CallNoSuchChannel, []byte(msg))
+		return
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline != 0 {
+		ctx, cancel = context.WithDeadline(context.Background(), time.Unix(0, deadline))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	key := servingKey{from, id}
+	r.Lock()
+	r.serving[key] = cancel
+	r.Unlock()
+
+	go func() {
+		defer func() {
+			r.Lock()
+			delete(r.serving, key)
+			r.Unlock()
+			cancel()
+		}()
+		response, err := handler(ctx, from, request)
+		if err != nil {
+			r.reply(from, id, CallHandlerFailed, []byte(err.Error()))
+			return
+		}
+		r.reply(from, id, callOK, response)
+	}()
+}
+
+func (r *RPC) reply(to EndPointAddress, id uint64, code CallErrorCode, response []byte) {
+	msg := make([]byte, 10, 10+len(response))
+	msg[0] = rpcReply
+	binary.BigEndian.PutUint64(msg[1:], id)
+	msg[9] = uint8(code)
+	SendPayload(r.channel, to, append(msg, response...))
+}
+
+func encodeCallRequest(id uint64, chanID ChannelID, deadline int64, request []byte) []byte {
+	msg := make([]byte, 25, 25+len(request))
+	msg[0] = rpcRequest
+	binary.BigEndian.PutUint64(msg[1:], id)
+	binary.BigEndian.PutUint64(msg[9:], uint64(chanID))
+	binary.BigEndian.PutUint64(msg[17:], uint64(deadline))
+	return append(msg, request...)
+}
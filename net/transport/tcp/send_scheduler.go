@@ -0,0 +1,273 @@
+package tcp
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+SendScheduler orders what goes out on one heavyweight connection.
+
+Payloads queue per lightweight connection, and the connections with something
+queued take turns (deficit round robin): every turn a connection may write up
+to sendQuantum bytes, with unused allowance carried over, so a connection
+sending 4MB messages gets the same share of the socket as one sending small
+ones, and waits its turn behind them.
+
+Control messages that do not depend on queued payloads (CreateNewConnection,
+stream credit) go out ahead of every payload. So does a control message for a
+lightweight connection (CloseConnection) as long as that connection has no
+payload queued; otherwise it queues behind the connection's own payloads.
+
+A "last" message (CloseEndPoint, the end of a drain) goes out after everything
+queued before it, and everything queued after it waits until it is written.
+CloseSocket takes the express lane instead, holding up nothing queued after
+it, unless payloads of closed connections are still queued: the peer must have
+those before it hears that the socket is unused.
+
+At most capacity payloads are queued at once; further pushes block. Control
+messages are never blocked.
+*/
+type SendScheduler struct {
+	// Ch is signalled whenever something is queued
+	Ch chan struct{}
+
+	mtx      sync.Mutex
+	space    sync.Cond
+	capacity int
+	payloads int // queued payloads, counted against capacity
+	express  []Sender
+	lanes    map[LightweightConnectionId]*sendLane
+	ring     []*sendLane // lanes with something queued, in turn order
+	turn     int         // index into ring of the lane whose turn it is
+	last     []sendItem  // everything queued after a "last" message, in order
+}
+
+const sendQuantum = 64 * 1024
+
+type sendItem struct {
+	sender  Sender
+	size    int
+	payload bool
+}
+
+type sendLane struct {
+	lcid    LightweightConnectionId
+	items   []sendItem
+	deficit int
+	started bool // whether the lane got its quantum for the current turn
+}
+
+func NewSendScheduler(capacity int) *SendScheduler {
+	s := &SendScheduler{
+		Ch:       make(chan struct{}, 1),
+		capacity: capacity,
+		lanes:    make(map[LightweightConnectionId]*sendLane),
+	}
+	s.space.L = &s.mtx
+	return s
+}
+
+func (s *SendScheduler) signal() {
+	select {
+	case s.Ch <- struct{}{}:
+	default:
+	}
+}
+
+// PushPayload queues a payload of size bytes for lightweight connection lcid,
+// blocking while the scheduler is full.
+func (s *SendScheduler) PushPayload(lcid LightweightConnectionId, size int, sender Sender) {
+	s.mtx.Lock()
+	for s.payloads >= s.capacity {
+		s.space.Wait()
+	}
+	s.payloads++
+	s.pushLane(lcid, sendItem{sender, size, true})
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// PushControl queues a control message for lightweight connection lcid,
+// behind that connection's payloads but ahead of everybody else's.
+func (s *SendScheduler) PushControl(lcid LightweightConnectionId, sender Sender) {
+	s.mtx.Lock()
+	if _, busy := s.lanes[lcid]; busy {
+		s.pushLane(lcid, sendItem{sender: sender})
+	} else {
+		s.pushExpress(sender)
+	}
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// PushExpress queues a control message ahead of every payload.
+func (s *SendScheduler) PushExpress(sender Sender) {
+	s.mtx.Lock()
+	s.pushExpress(sender)
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// PushLast queues a message behind everything queued so far.
+func (s *SendScheduler) PushLast(sender Sender) {
+	s.mtx.Lock()
+	s.last = append(s.last, sendItem{sender: sender})
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// PushClose queues a CloseSocket message, see above.
+func (s *SendScheduler) PushClose(sender Sender) {
+	s.mtx.Lock()
+	if len(s.ring) > 0 {
+		s.last = append(s.last, sendItem{sender: sender})
+	} else {
+		s.pushExpress(sender)
+	}
+	s.mtx.Unlock()
+	s.signal()
+}
+
+func (s *SendScheduler) pushExpress(sender Sender) {
+	if len(s.last) > 0 {
+		s.last = append(s.last, sendItem{sender: sender})
+		return
+	}
+	s.express = append(s.express, sender)
+}
+
+func (s *SendScheduler) pushLane(lcid LightweightConnectionId, item sendItem) {
+	if len(s.last) > 0 {
+		s.last = append(s.last, item)
+		return
+	}
+	lane, ok := s.lanes[lcid]
+	if !ok {
+		lane = &sendLane{lcid: lcid}
+		s.lanes[lcid] = lane
+		s.ring = append(s.ring, lane)
+	}
+	lane.items = append(lane.items, item)
+}
+
+// Len returns the number of queued messages.
+func (s *SendScheduler) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	n := len(s.express) + len(s.last)
+	for _, lane := range s.ring {
+		n += len(lane.items)
+	}
+	return n
+}
+
+// Next returns the next message to write, waiting for one if necessary. Only
+// one goroutine may take messages from a scheduler.
+func (s *SendScheduler) Next() Sender {
+	for {
+		if sender := s.TryNext(); sender != nil {
+			return sender
+		}
+		<-s.Ch
+	}
+}
+
+// TryNext returns the next message to write, or nil if nothing is queued.
+func (s *SendScheduler) TryNext() Sender {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	item, ok := s.pick()
+	if !ok {
+		return nil
+	}
+	if item.payload {
+		s.payloads--
+		s.space.Signal()
+	}
+	return item.sender
+}
+
+// RunQueued writes the messages that are queued right now to w and returns
+// how many there were.
+func (s *SendScheduler) RunQueued(w io.Writer) int {
+	n := s.Len()
+	for i := 0; i < n; i++ {
+		sender := s.TryNext()
+		if sender == nil {
+			return i
+		}
+		sender(w)
+	}
+	return n
+}
+
+func (s *SendScheduler) pick() (sendItem, bool) {
+	if len(s.express) > 0 {
+		sender := s.express[0]
+		s.express[0] = nil
+		s.express = s.express[1:]
+		return sendItem{sender: sender}, true
+	}
+	for passed := 0; len(s.ring) > 0; {
+		if s.turn >= len(s.ring) {
+			s.turn = 0
+		}
+		if passed == len(s.ring) {
+			s.skipIdleRounds()
+			passed = 0
+		}
+		lane := s.ring[s.turn]
+		if !lane.started {
+			lane.deficit += sendQuantum
+			lane.started = true
+		}
+		item := lane.items[0]
+		if item.size > lane.deficit {
+			// not enough allowance left, the next lane's turn
+			lane.started = false
+			s.turn++
+			passed++
+			continue
+		}
+		lane.deficit -= item.size
+		lane.items[0] = sendItem{}
+		lane.items = lane.items[1:]
+		if len(lane.items) == 0 {
+			// the next lane moves up into this slot
+			delete(s.lanes, lane.lcid)
+			s.ring = append(s.ring[:s.turn], s.ring[s.turn+1:]...)
+		}
+		return item, true
+	}
+	if len(s.last) > 0 {
+		item := s.last[0]
+		s.last[0] = sendItem{}
+		s.last = s.last[1:]
+		return item, true
+	}
+	return sendItem{}, false
+}
+
+// skipIdleRounds gives every lane, in one step, the quanta of the rounds in
+// which none of them could send, as a 4MB payload would otherwise take 64
+// rounds of adding sendQuantum. It is called after a whole round in which
+// nothing was sent, so no lane has started its turn.
+func (s *SendScheduler) skipIdleRounds() {
+	rounds := -1
+	for _, lane := range s.ring {
+		// the turn of the lane adds one quantum itself
+		need := 0
+		if short := lane.items[0].size - lane.deficit - sendQuantum; short > 0 {
+			need = (short + sendQuantum - 1) / sendQuantum
+		}
+		if rounds < 0 || need < rounds {
+			rounds = need
+		}
+	}
+	for _, lane := range s.ring {
+		lane.deficit += rounds * sendQuantum
+	}
+}
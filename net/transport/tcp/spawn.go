@@ -0,0 +1,329 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+A node runs registered functions for other nodes. Spawn makes two calls (see
+rpc.go) to the reserved channel spawnChannelID of the node that is to run the
+function:
+
+	spawn   name-length name args    answered with the task
+	run     task                     answered with the result
+
+name-length is a uint16, args a typed message (see codec.go) for the codec the
+function was registered with, and the result a typed message as well. task is
+the uint64 id of the channel that the run gets on the callee. The callee picks
+it from the task ids, which start at firstTaskChannelID and are never reused,
+and counts the caller among the watchers of the task before it answers.
+
+The caller watches the task once it knows it, and only then asks for the run,
+so the caller's monitor sees the task end whatever happens: DiedNormal when the
+function returns, DiedException when it fails, DiedDisconnect or DiedNodeDown
+when the callee is lost, and DiedUnknownId when the run never started because
+the run call did not come within the callee's open timeout (see
+SetOpenTimeout). A spawn of a function the callee does not have, or of args it
+cannot decode, fails at once, with no task to watch.
+*/
+
+const (
+	spawnStart uint8 = iota
+	spawnRun
+)
+
+// ErrNoSuchFunction is the error of spawning a function that is not
+// registered on the node asked to run it. The caller gets its message in a
+// *CallError.
+var ErrNoSuchFunction = errors.New("no such function")
+
+var errNoSuchTask = errors.New("no such task")
+
+// Function is a function that other nodes can run. task is the channel of
+// the run, closed once it returns; ctx is done when the caller gives up.
+type Function func(ctx context.Context, task *LocalChannel, args any) (any, error)
+
+// Functions are the functions a node runs for others, by name.
+type Functions struct {
+	node *LocalNode
+
+	sync.Mutex
+	fns      map[string]registered
+	nextTask uint64
+	pending  map[ChannelID]*pendingRun // tasks waiting for their run call
+}
+
+type registered struct {
+	codec *Codec
+	fn    Function
+}
+
+type pendingRun struct {
+	from    EndPointAddress
+	fn      registered
+	args    any
+	channel *LocalChannel
+	timer   *time.Timer
+}
+
+// TaskResult is what a spawned function returned.
+type TaskResult struct {
+	Value any
+	Err   error
+}
+
+// Task is a function spawned on another node.
+type Task struct {
+	// The channel of the run, on the node that runs it
+	Ref ChannelRef
+	// The monitor of Ref, whose ChannelDown arrives on the Down channel of
+	// the channel that spawned the task
+	Monitor MonitorRef
+	// Receives the result once, then is closed
+	Result <-chan TaskResult
+}
+
+// startFunctions starts serving spawns.
+func (node *LocalNode) startFunctions() error {
+	channel, err := newLocalChannel(node, spawnChannelID, nil)
+	if err != nil {
+		return err
+	}
+	fs := &Functions{
+		node:    node,
+		fns:     make(map[string]registered),
+		pending: make(map[ChannelID]*pendingRun),
+	}
+	node.localFunctions = fs
+	HandleCalls(channel, fs.serve)
+	return nil
+}
+
+// RegisterFunction lets other nodes run fn under name. codec decodes its
+// arguments and encodes its result.
+func RegisterFunction(node *LocalNode, name string, codec *Codec, fn Function) error {
+	if len(name) > math.MaxUint16 {
+		return fmt.Errorf("register %q: name too long", name)
+	}
+	fs := node.localFunctions
+	fs.Lock()
+	defer fs.Unlock()
+
+	if _, ok := fs.fns[name]; ok {
+		return fmt.Errorf("register %q: already registered", name)
+	}
+	fs.fns[name] = registered{codec, fn}
+	return nil
+}
+
+// Spawn runs the function name of the node at to with args, encoded by the
+// codec of localChannel, which also decodes the result. It returns once the
+// callee has set up the task; localChannel then monitors the run: a
+// ChannelDown for task.Monitor arrives on its Down channel when the run ends,
+// or its node is lost. ctx bounds the run, as it does a call.
+func Spawn(ctx context.Context, localChannel *LocalChannel, to EndPointAddress, name string, args any) (*Task, error) {
+	codec := localChannel.codec
+	if codec == nil {
+		return nil, errNoCodec
+	}
+	if len(name) > math.MaxUint16 {
+		return nil, fmt.Errorf("spawn %q: name too long", name)
+	}
+	body, err := codec.Encode(args)
+	if err != nil {
+		return nil, err
+	}
+
+	node := localChannel.localNode
+	response, err := node.Call(ctx, to, spawnChannelID, encodeSpawn(name, body))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) != 8 {
+		return nil, fmt.Errorf("spawn %q: invalid task", name)
+	}
+	task := ChannelID(binary.BigEndian.Uint64(response))
+	ref := MonitorRef{
+		Watcher: node.channelRef(localChannel.channelID),
+		Target:  ChannelRef{to, task},
+		Id:      node.localMonitors.nextId.Add(1),
+	}
+	node.localMonitors.watch(ref)
+
+	result := make(chan TaskResult, 1)
+	go func() {
+		defer close(result)
+		response, err := node.Call(ctx, to, spawnChannelID, encodeRun(task))
+		if err != nil {
+			// unless the callee tells the monitor how the run ended, it
+			// never started; a monitor that fired for a lost node already
+			// stays quiet
+			var callErr *CallError
+			told := errors.As(err, &callErr) && callErr.Code == CallHandlerFailed
+			if !told && ctx.Err() == nil {
+				node.signal(&Died{ref.Target, DiedUnknownId{}})
+			}
+			result <- TaskResult{nil, err}
+			return
+		}
+		v, err := codec.Decode(response)
+		result <- TaskResult{v, err}
+	}()
+	return &Task{ref.Target, ref, result}, nil
+}
+
+// serve serves the calls of Spawn.
+func (fs *Functions) serve(ctx context.Context, from EndPointAddress, request []byte) ([]byte, error) {
+	if len(request) == 0 {
+		return nil, errors.New("spawn too short")
+	}
+	switch request[0] {
+	case spawnStart:
+		return fs.start(from, request[1:])
+	case spawnRun:
+		return fs.claim(ctx, from, request[1:])
+	}
+	return nil, fmt.Errorf("unknown spawn request %d", request[0])
+}
+
+// start sets up the task of a spawn, which waits for its run call.
+func (fs *Functions) start(from EndPointAddress, request []byte) ([]byte, error) {
+	node := fs.node
+	name, body, err := decodeSpawn(request)
+	if err != nil {
+		return nil, err
+	}
+	fs.Lock()
+	f, ok := fs.fns[name]
+	fs.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoSuchFunction, name)
+	}
+	args, err := f.codec.Decode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Lock()
+	task := firstTaskChannelID + ChannelID(fs.nextTask)
+	fs.nextTask++
+	fs.Unlock()
+	channel, err := newLocalChannel(node, task, nil)
+	if err != nil {
+		return nil, err
+	}
+	SetCodec(channel, f.codec)
+	node.localMonitors.addWatcher(task, from)
+
+	opens := node.localOpens
+	opens.Lock()
+	timeout := opens.timeout
+	opens.Unlock()
+	fs.Lock()
+	fs.pending[task] = &pendingRun{
+		from:    from,
+		fn:      f,
+		args:    args,
+		channel: channel,
+		timer:   time.AfterFunc(timeout, func() { fs.abandon(task) }),
+	}
+	fs.Unlock()
+
+	response := make([]byte, 8)
+	binary.BigEndian.PutUint64(response, uint64(task))
+	return response, nil
+}
+
+// claim runs a task. Whatever fails, the caller's monitor of the task is
+// told.
+func (fs *Functions) claim(ctx context.Context, from EndPointAddress, request []byte) ([]byte, error) {
+	node := fs.node
+	if len(request) != 8 {
+		return nil, errors.New("invalid run request")
+	}
+	task := ChannelID(binary.BigEndian.Uint64(request))
+	fs.Lock()
+	p, ok := fs.pending[task]
+	if ok && p.from == from {
+		delete(fs.pending, task)
+	}
+	fs.Unlock()
+	if !ok || p.from != from {
+		node.post(from, encodeDied(task, DiedUnknownId{}))
+		return nil, errNoSuchTask
+	}
+	p.timer.Stop()
+
+	v, err := run(ctx, p.fn.fn, p.channel, p.args)
+	var response []byte
+	if err == nil {
+		response, err = p.fn.codec.Encode(v)
+	}
+	if err != nil {
+		node.signal(&Kill{task, err.Error()})
+		return nil, err
+	}
+	CloseLocalChannel(p.channel)
+	return response, nil
+}
+
+// abandon drops a task whose run call did not come in time.
+func (fs *Functions) abandon(task ChannelID) {
+	node := fs.node
+	fs.Lock()
+	p, ok := fs.pending[task]
+	delete(fs.pending, task)
+	fs.Unlock()
+	if !ok {
+		return
+	}
+	conns, err := node.removeLocalChannel(task)
+	if err != nil {
+		return
+	}
+	p.channel.shutdown(conns)
+	node.signal(&Died{node.channelRef(task), DiedUnknownId{}})
+}
+
+// run runs fn, turning a panic into an error.
+func run(ctx context.Context, fn Function, task *LocalChannel, args any) (v any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx, task, args)
+}
+
+func encodeSpawn(name string, args []byte) []byte {
+	msg := make([]byte, 3, 3+len(name)+len(args))
+	msg[0] = spawnStart
+	binary.BigEndian.PutUint16(msg[1:], uint16(len(name)))
+	msg = append(msg, name...)
+	return append(msg, args...)
+}
+
+func encodeRun(task ChannelID) []byte {
+	msg := make([]byte, 9)
+	msg[0] = spawnRun
+	binary.BigEndian.PutUint64(msg[1:], uint64(task))
+	return msg
+}
+
+// decodeSpawn decodes a spawn request, past its kind.
+func decodeSpawn(msg []byte) (string, []byte, error) {
+	if len(msg) < 2 {
+		return "", nil, errors.New("spawn too short")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	if len(msg) < 2+n {
+		return "", nil, errors.New("spawn too short")
+	}
+	return string(msg[2 : 2+n]), msg[2+n:], nil
+}
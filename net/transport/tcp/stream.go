@@ -0,0 +1,359 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+A stream carries a message too large to be held in memory as one payload
+(tcpMaxReceiveLength bounds those). The sender cuts it into fragments that
+travel as control messages on the stream's lightweight connection:
+
+	StreamData   lcid len bytes   a fragment; an empty fragment ends the stream
+	StreamAbort  lcid             the sender failed to read the rest
+	StreamCredit lcid n           the receiver consumed n more fragments
+
+Every fragment is queued on the heavyweight connection by itself, so messages
+on other lightweight connections are interleaved with a stream in progress.
+
+Reassembly is bounded by credit: a stream starts with streamWindow fragments of
+credit and the receiver hands one back for every fragment the application has
+read (or discarded). The receiver therefore never buffers more than
+streamWindow * streamChunkSize bytes per stream, and the socket reader never
+has to wait for a slow consumer. A peer that sends beyond its credit brings the
+heavyweight connection down.
+*/
+const (
+	streamChunkSize = 64 * 1024
+	streamWindow    = 16
+)
+
+var (
+	errStreamAborted      = errors.New("stream aborted by the sender")
+	errStreamLost         = errors.New("connection lost before the stream ended")
+	errStreamBusy         = errors.New("a stream is already being sent on this connection")
+	errStreamOverrun      = errors.New("stream fragment beyond the granted credit")
+	errStreamReaderClosed = errors.New("read from a closed stream")
+)
+
+//------------------------------------------------------------------------------
+// Sending                                                                    --
+//------------------------------------------------------------------------------
+
+// StreamWindows tracks the credit of the streams we are sending to one remote
+// endpoint, by lightweight connection.
+type StreamWindows struct {
+	sync.Mutex
+	windows map[LightweightConnectionId]chan struct{}
+	failed  chan struct{} // closed once the heavyweight connection is gone
+	err     error
+}
+
+func newStreamWindows() *StreamWindows {
+	return &StreamWindows{
+		windows: make(map[LightweightConnectionId]chan struct{}),
+		failed:  make(chan struct{}),
+	}
+}
+
+// open starts a stream on lcid with a full window of credit.
+func (sw *StreamWindows) open(lcid LightweightConnectionId) (chan struct{}, error) {
+	sw.Lock()
+	defer sw.Unlock()
+
+	if sw.err != nil {
+		return nil, sw.err
+	}
+	if _, ok := sw.windows[lcid]; ok {
+		return nil, errStreamBusy
+	}
+	window := make(chan struct{}, streamWindow)
+	for i := 0; i < streamWindow; i++ {
+		window <- struct{}{}
+	}
+	sw.windows[lcid] = window
+	return window, nil
+}
+
+func (sw *StreamWindows) close(lcid LightweightConnectionId) {
+	sw.Lock()
+	defer sw.Unlock()
+
+	delete(sw.windows, lcid)
+}
+
+// acquire takes one fragment of credit, waiting for the receiver if needed.
+func (sw *StreamWindows) acquire(window chan struct{}) error {
+	select {
+	case <-window:
+		return nil
+	case <-sw.failed:
+		return sw.err
+	}
+}
+
+// drain waits until the receiver has handed back every fragment of credit,
+// that is, until it consumed or discarded the whole stream.
+func (sw *StreamWindows) drain(window chan struct{}) error {
+	for i := 0; i < streamWindow; i++ {
+		if err := sw.acquire(window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grant returns credit from a StreamCredit message. Credit for streams we are
+// no longer sending, or beyond the window, is ignored.
+func (sw *StreamWindows) grant(lcid LightweightConnectionId, n uint32) {
+	sw.Lock()
+	window := sw.windows[lcid]
+	sw.Unlock()
+
+	for ; window != nil && n > 0; n-- {
+		select {
+		case window <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// fail wakes up every sender waiting for credit; called when the socket reader
+// exits, since no credit can arrive after that.
+func (sw *StreamWindows) fail(err error) {
+	sw.Lock()
+	defer sw.Unlock()
+
+	if sw.err == nil {
+		sw.err = err
+		close(sw.failed)
+	}
+}
+
+// | Send everything read from r as one stream on a lightweight connection
+//
+// Returns once the receiver has consumed (or discarded) the whole stream. If
+// reading r fails the stream is aborted and the error returned.
+func (ourEndPoint *LocalEndPoint) apiSendStream(theirEndPoint *RemoteEndPoint, connId LightweightConnectionId, r io.Reader, connAlive *AtomicBool) (int64, error) {
+	streams := theirEndPoint.remoteStreams
+	window, err := streams.open(connId)
+	if err != nil {
+		return 0, err
+	}
+	defer streams.close(connId)
+
+	var sent int64
+	for {
+		buf := getBuffer(streamChunkSize)
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := streams.acquire(window); err != nil {
+				putBuffer(buf)
+				return sent, err
+			}
+			chunk := buf[:n]
+			err := theirEndPoint.sendOnConnection(connAlive, func(vst *ValidRemoteEndPointState) {
+				vst.sendPayload(connId, len(chunk), func(w io.Writer) {
+					sendStreamData(uint32(connId), chunk, w)
+					putBuffer(chunk)
+				})
+			})
+			if err != nil {
+				putBuffer(buf)
+				return sent, err
+			}
+			sent += int64(n)
+		} else {
+			putBuffer(buf)
+		}
+
+		switch readErr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			err := theirEndPoint.sendOnConnection(connAlive, func(vst *ValidRemoteEndPointState) {
+				vst.sendPayload(connId, 0, func(w io.Writer) {
+					sendStreamData(uint32(connId), nil, w)
+				})
+			})
+			if err != nil {
+				return sent, err
+			}
+			return sent, streams.drain(window)
+		default:
+			// the receiver drops what it buffered and hands the credit back
+			err := theirEndPoint.sendOnConnection(connAlive, func(vst *ValidRemoteEndPointState) {
+				vst.sendControl(connId, func(w io.Writer) {
+					sendStreamAbort(uint32(connId), w)
+				})
+			})
+			if err == nil {
+				streams.drain(window)
+			}
+			return sent, readErr
+		}
+	}
+}
+
+// sendOnConnection lets send queue a message on the heavyweight connection,
+// failing the same way apiSend does if the lightweight connection or the
+// remote endpoint is gone.
+func (theirEndPoint *RemoteEndPoint) sendOnConnection(connAlive *AtomicBool, send func(*ValidRemoteEndPointState)) error {
+	theirState := &theirEndPoint.remoteState
+	theirState.Lock()
+	defer theirState.Unlock()
+
+	if !connAlive.IsSet() {
+		return ErrConnectionClosed
+	}
+	switch st := theirState.value.(type) {
+	case *RemoteEndPointValid:
+		send(&st._1)
+		return nil
+	case *RemoteEndPointFailed:
+		return st._1
+	default:
+		return errors.New("apiSendStream " + theirState.value.String())
+	}
+}
+
+//------------------------------------------------------------------------------
+// Receiving                                                                  --
+//------------------------------------------------------------------------------
+
+// StreamReader is the receiving end of a stream, delivered in a ReceivedStream
+// event. Read returns io.EOF once the whole stream has been read. A
+// StreamReader that is not going to be read to the end should be closed, or
+// the sender will wait for it forever.
+type StreamReader struct {
+	mu     sync.Mutex
+	ready  sync.Cond
+	chunks [][]byte // fragments not yet read, at most streamWindow
+	offset int      // bytes of chunks[0] already read
+	err    error    // io.EOF once the stream ended, or why it failed
+	closed bool
+	credit func(n uint32)
+}
+
+func newStreamReader(credit func(n uint32)) *StreamReader {
+	sr := &StreamReader{credit: credit}
+	sr.ready.L = &sr.mu
+	return sr
+}
+
+// push hands a fragment from the socket reader to the stream.
+func (sr *StreamReader) push(chunk []byte) error {
+	sr.mu.Lock()
+	if sr.closed {
+		sr.mu.Unlock()
+		putBuffer(chunk)
+		// the socket reader holds no lock, and credit only queues a message
+		sr.credit(1)
+		return nil
+	}
+	defer sr.mu.Unlock()
+
+	if len(sr.chunks) >= streamWindow {
+		putBuffer(chunk)
+		return errStreamOverrun
+	}
+	sr.chunks = append(sr.chunks, chunk)
+	sr.ready.Signal()
+	return nil
+}
+
+// finish ends the stream. Unless it ended normally, fragments that were not
+// read yet are dropped.
+func (sr *StreamReader) finish(err error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.err == nil {
+		sr.err = err
+	}
+	if err != io.EOF {
+		if n := sr.release(); n > 0 {
+			go sr.credit(n)
+		}
+	}
+	sr.ready.Broadcast()
+}
+
+// release drops the buffered fragments and returns how many there were.
+func (sr *StreamReader) release() uint32 {
+	n := uint32(len(sr.chunks))
+	for _, chunk := range sr.chunks {
+		putBuffer(chunk)
+	}
+	sr.chunks, sr.offset = nil, 0
+	return n
+}
+
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	sr.mu.Lock()
+	for len(sr.chunks) == 0 && sr.err == nil && !sr.closed {
+		sr.ready.Wait()
+	}
+	if sr.closed {
+		sr.mu.Unlock()
+		return 0, errStreamReaderClosed
+	}
+	if len(sr.chunks) == 0 {
+		err := sr.err
+		sr.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, sr.chunks[0][sr.offset:])
+	sr.offset += n
+	consumed := sr.offset == len(sr.chunks[0])
+	if consumed {
+		putBuffer(sr.chunks[0])
+		sr.chunks[0] = nil
+		sr.chunks, sr.offset = sr.chunks[1:], 0
+	}
+	sr.mu.Unlock()
+
+	if consumed {
+		sr.credit(1)
+	}
+	return n, nil
+}
+
+// Close discards the rest of the stream. The sender is still given credit for
+// it, so that it can finish.
+func (sr *StreamReader) Close() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.closed {
+		return nil
+	}
+	sr.closed = true
+	if n := sr.release(); n > 0 {
+		go sr.credit(n)
+	}
+	sr.ready.Broadcast()
+	return nil
+}
+
+// sendStreamCredit hands n fragments of credit for lcid back to the sender.
+// Nothing is sent once the heavyweight connection is going away.
+func (theirEndPoint *RemoteEndPoint) sendStreamCredit(lcid LightweightConnectionId, n uint32) {
+	theirState := &theirEndPoint.remoteState
+	theirState.Lock()
+	defer theirState.Unlock()
+
+	switch st := theirState.value.(type) {
+	case *RemoteEndPointValid:
+		st._1.sendExpress(func(w io.Writer) {
+			sendStreamCredit(uint32(lcid), n, w)
+		})
+	case *RemoteEndPointClosing:
+		st._2.sendExpress(func(w io.Writer) {
+			sendStreamCredit(uint32(lcid), n, w)
+		})
+	}
+}
@@ -384,7 +384,7 @@
 ;;; TODO
 
 (deftest invalidCloseConnection
-    (<- internal (createTCPTransport "127.0.0.1:9999"))
+    (<- internal (createTCPTransport "127.0.0.1:9999" defaultTCPParameters))
     (let 
         transport (internal.ToTransport)
         serverDone (newNotifier)
@@ -8,7 +8,9 @@
 (struct TCPTransport
     transportAddr TransportAddr
     transportState (MVar TransportState)
-    transportParams *TCPParameters)
+    transportParams *TCPParameters
+    ;; | Answers (and asks) name lookups from the system endpoint
+    transportRegistry *Registry)
 
 
 (enum TransportState
@@ -18,14 +20,21 @@
 
 (struct ValidTransportState
     _localEndPoints (Map EndPointId *LocalEndPoint)
-    _nextEndPointId EndPointId)
+    _nextEndPointId EndPointId
+    ;; | Allocated ids handed back with ReleaseEndPointId, reused only once
+    ;; _nextEndPointId has run out
+    _releasedEndPointIds (Set EndPointId)
+    ;; | Names registered for local endpoints
+    _registeredNames (Map String EndPointId))
 
 
 (struct LocalEndPoint
     localAddress EndPointAddress
     localState  (MVar LocalEndPointState)
     localQueue   (Chan Event)
-    shakeHand  ShakeHand)
+    shakeHand  ShakeHand
+    ;; | Reliable sessions peers are sending to us; they outlive sockets
+    localSessions *InboundSessions)
 
 
 (enum LocalEndPointState
@@ -36,16 +45,31 @@
 (struct ValidLocalEndPointState
     _localNextConnOutId   LightweightConnectionId
     _nextConnInId       HeavyweightConnectionId
-    _localConnections   (Map EndPointAddress *RemoteEndPoint))
+    _localConnections   (Map SocketKey *RemoteEndPoint)
+    ;; | Stripe for the next lightweight connection we open
+    _localNextStripe    UInt32)
 
 
 ;;; REMOTE ENDPOINTS
 
+;; | Remote endpoints are kept per socket. With striping (tcpStripes) there
+;; are several sockets to the same address, numbered from 0.
+(struct SocketKey
+    address EndPointAddress
+    stripe  UInt32)
+
 (struct RemoteEndPoint
     remoteAddress EndPointAddress
+    remoteStripe  UInt32
     remoteState (MVar RemoteState)
     remoteId    HeavyweightConnectionId
-    remoteScheduled     (Chan Action))
+    remoteScheduled     (Chan Action)
+    ;; | Notified once the socket reader for this endpoint has exited
+    remoteReaderDone    Notifier
+    ;; | Send windows of the streams we are sending to this endpoint
+    remoteStreams       *StreamWindows
+    ;; | Delivery acknowledgements of our connections to this endpoint
+    remoteAcks          *AckTable)
 
 (enum RequestedBy
     RequestedByUs
@@ -74,10 +98,18 @@
     remoteConn Conn
     ; remoteSendLock Lock
     ;; for batch send
-    sendQueue    (Chan Sender)  ; send queue
-    flushTimer   *ThrottleTimer ; flush writes as necessary but throttled.
+    sendQueue    *SendScheduler ; connections take turns, control messages go first
+    flushMode    FlushMode      ; when sendRoutine flushes bufWriter
+    flushTimer   *ThrottleTimer ; flush writes as necessary but throttled; nil unless FlushThrottled
     bufWriter   BufferedOutputStream)
 
+(enum FlushMode
+    "When the send routine flushes the write buffer of a heavyweight connection"
+    ;; | Flush as soon as the send queue is drained
+    FlushOnIdle
+    ;; | Flush at most every flushThrottleMS after the first write of a burst
+    FlushThrottled)
+
 ;;; Parameters for setting up the TCP transport
 (struct TCPParameters
     ;; | Maximum length (in bytes) for a peer's address.
@@ -89,7 +121,22 @@
     ;; the limit, the heavyweight connection which carries that lightweight
     ;; connection will go down. The peer and the local node will get an
     ;; EventConnectionLost.
-    tcpMaxReceiveLength UInt32)
+    tcpMaxReceiveLength UInt32
+    ;; | How outgoing heavyweight connections flush their write buffer.
+    tcpFlushMode FlushMode
+    ;; | How long a graceful endpoint close waits for queued messages to be
+    ;; flushed and for peers to close their sockets.
+    tcpCloseTimeout Duration
+    ;; | Number of heavyweight connections (sockets) we open to each remote
+    ;; endpoint. Lightweight connections are spread over them round robin,
+    ;; each one staying on a single socket.
+    tcpStripes UInt32
+    ;; | Number of unacknowledged messages a reliable connection keeps for
+    ;; resending. Send blocks while the buffer is full.
+    tcpRetransmitBuffer UInt32
+    ;; | How long a reliable connection keeps trying to reconnect before it
+    ;; fails for good.
+    tcpReconnectTimeout Duration)
 
 ;;; macros
 
@@ -113,7 +160,8 @@
         [^*LocalEndPoint ourEndPoint]
         (withValidTransportState! transport *vst
             (let epid ourEndPoint.localAddress.EndPointId)
-            (.remove vst._localEndPoints epid))))
+            (.remove vst._localEndPoints epid)
+            (vst.forgetNames epid))))
 
 (defmacro withValidLocalEndPointState! [ourEndPoint vst & body]
     (let [st (symbol (str "&" ourEndPoint ".localState"))
@@ -132,10 +180,12 @@
  If the local endpoint is closed, do nothing"
         [^*RemoteEndPoint theirEndPoint]
         (withValidLocalEndPointState! ourEndPoint *vst
-            (.remove vst._localConnections theirEndPoint.remoteAddress))))
+            (.remove vst._localConnections (theirEndPoint.socketKey)))))
 
 (def minWriteBufferSize 65536)
+(def minReadBufferSize 65536)
 (def flushThrottleMS 100)
+(def sendQueueCapacity 1000)
 
 (type Sender (fn [OutputStream]))
 
@@ -147,6 +197,7 @@
     (ConnectionClosed ConnectionId)
     (ConnectionOpened ConnectionId EndPointAddress)
     EndPointClosed
+    (ReceivedStream ConnectionId *StreamReader)
     (ErrorEvent EventErrorCode Error))
 
 ; (enum NewEndPointErrorCode
@@ -172,7 +223,19 @@
     CreateNewConnection
     CloseConnection
     CloseSocket
-    CloseEndPoint)
+    CloseEndPoint
+    ;; | A fragment of a stream; an empty fragment ends the stream
+    StreamData
+    ;; | The sender gave up on a stream half way
+    StreamAbort
+    ;; | The receiver consumed fragments and grants more
+    StreamCredit
+    ;; | The sender wants a lightweight connection acknowledged
+    AckRequest
+    ;; | The receiver enqueued this many messages of a lightweight connection
+    Ack
+    ;; | A lightweight connection carries (or resumes) a reliable session
+    SessionOpen)
     ; ProbeSocket
     ; ProbeSocketAct)
 
@@ -186,7 +249,8 @@
 (deferr
     TransportClosed "Transport closed"
     EndPointClosed  "EndPoint closed"
-    ConnectionClosed "Connection closed")
+    ConnectionClosed "Connection closed"
+    RemoteEndPointClosed "The remote endpoint was closed.")
     
 (defmacro message! [n]
     `(do (encode! ~n)
@@ -203,17 +267,36 @@
 
 
 (impl ^*ValidRemoteEndPointState vst
-    (defn sendOn 
-        "| Send a payload over a heavyweight connection (thread safe)"
+    (defn sendPayload
+        "| Send a payload over a heavyweight connection (thread safe)
+
+ Lightweight connections with payloads queued take turns."
+        [^LightweightConnectionId lcid ^int size ^Sender sender]
+        (vst.sendQueue.PushPayload lcid size sender))
+
+    (defn sendControl
+        "| Send a control message about a lightweight connection, ahead of the
+ other connections' payloads but behind its own"
+        [^LightweightConnectionId lcid ^Sender sender]
+        (vst.sendQueue.PushControl lcid sender))
+
+    (defn sendExpress
+        "| Send a control message ahead of every queued payload"
         [^Sender sender]
-        ; (lock! vst.remoteSendLock)
-        ; (sender vst.bufWriter)
-        (>! vst.sendQueue sender))
-        ; (vst.flushTimer.Set))
+        (vst.sendQueue.PushExpress sender))
+
+    (defn sendLast
+        "| Send a message after everything queued so far (closing the endpoint)"
+        [^Sender sender]
+        (vst.sendQueue.PushLast sender))
+
+    (defn sendClose
+        "| Send CloseSocket, ahead of everything unless payloads are still queued"
+        [^Sender sender]
+        (vst.sendQueue.PushClose sender))
 
     (defn flush []
         ; (lock! vst.remoteSendLock)
-        (println "flushing...")
         (let err (.flush vst.bufWriter))
         (when (not= err nil)
             (println "warn flush failed " err)))
@@ -231,19 +314,29 @@
         "batch send"
         []
         (let vst &st._1)
-        (forever
-            (alt!
-                vst.flushTimer.Ch ([_] (vst.flush))
-                vst.sendQueue ([sender]
-                               (sender vst.bufWriter)
-                               (vst.flushTimer.Set))))))
+        (match vst.flushMode
+            FlushThrottled
+            (forever
+                (alt!
+                    vst.flushTimer.Ch ([_] (vst.flush))
+                    vst.sendQueue.Ch ([_]
+                                      (when (> (vst.sendQueue.RunQueued vst.bufWriter) 0)
+                                          (vst.flushTimer.Set)))))
+
+            ;; FlushOnIdle: keep coalescing only while more senders are
+            ;; already queued
+            (forever
+                (let sender (vst.sendQueue.Next))
+                (sender vst.bufWriter)
+                (when (= (vst.sendQueue.Len) 0)
+                    (vst.flush))))))
             
 
 ;;; constructor
 (defn newTransportState ^TransportState []
   (return
     (&TransPortValid.
-        (map->ValidTransportState {_nextEndPointId 0}))))
+        (map->ValidTransportState {_nextEndPointId FirstAllocatedEndPointId}))))
 
 (defn newTCPTransport ^*TCPTransport 
     [^string lAddr ^*TCPParameters params]
@@ -267,20 +360,22 @@
 (def firstNonReservedHeavyweightConnectionId 
     (HeavyweightConnectionId 1))
   
-(defn newRemoteEndPointValid ^*RemoteEndPointValid [^Conn conn]
+(defn newRemoteEndPointValid ^*RemoteEndPointValid [^Conn conn ^*TCPParameters params]
     (return
       (&RemoteEndPointValid.
         (map->ValidRemoteEndPointState {remoteConn conn
                                         _remoteNextConnOutId firstNonReservedLightweightConnectionId
-                                        sendQueue (native "make(chan Sender, 1000)")
-                                        flushTimer (NewThrottleTimer "flush" flushThrottleMS)
+                                        sendQueue (NewSendScheduler sendQueueCapacity)
+                                        flushMode params.tcpFlushMode
+                                        flushTimer (newFlushTimer params.tcpFlushMode)
                                         bufWriter (BufferedOutputStream. conn minWriteBufferSize)}))))
 
 (defn createTCPTransport
     ^*TCPTransport
-    [^string lAddr]
-    (let tp (newTCPTransport lAddr defaultTCPParameters))
+    [^string lAddr ^*TCPParameters params]
+    (let tp (newTCPTransport lAddr params))
     (<- (tp.forkServer tp.handleConnectionRequest))
+    (<- (tp.startRegistry))
     (return tp))
 
 ;;;------------------------------------------------------------------------------
@@ -297,9 +392,17 @@
         (return (map->&EndPoint {Close (fn ^Error []
                                             (return (tp.apiCloseEndPoint 
                                                         (native "[]Event{EndPointClosed{}}")
-                                                        ourEndPoint)))
+                                                        ourEndPoint
+                                                        tp.transportParams.tcpCloseTimeout)))
+                                 CloseNow (fn ^Error []
+                                            (return (tp.apiCloseEndPoint
+                                                        (native "[]Event{EndPointClosed{}}")
+                                                        ourEndPoint
+                                                        0)))
                                  Dial (fn ^"*Connection, error" [^EndPointAddress theirAddress]
                                             (return (tp.transportParams.apiConnect ourEndPoint theirAddress)))
+                                 DialReliable (fn ^"*Connection, error" [^EndPointAddress theirAddress]
+                                            (return (tp.transportParams.apiConnectReliable ourEndPoint theirAddress)))
                                  Receive (fn ^Event []
                                             (return (<! ourEndPoint.localQueue)))
                                  Address (fn ^EndPointAddress []
@@ -324,8 +427,9 @@
                         (return nil))))
         
         (when (not (nil? st))
-            (st.sendOn (fn [^OutputStream conn]
-                           (sendCloseConnection (uint32 connId) conn))))
+            (st.sendControl connId
+                (fn [^OutputStream conn]
+                    (sendCloseConnection (uint32 connId) conn))))
         (ourEndPoint.closeIfUnused theirEndPoint)
         (return nil))
 
@@ -335,8 +439,8 @@
         [^*RemoteEndPoint theirEndPoint 
          ^LightweightConnectionId connId
          ^ByteString msg
-         ^*AtomicBool connAlive]
-        (println "apiSend" connId (count msg))
+         ^*AtomicBool connAlive
+         ^*Acks acks]
         (let theirState &theirEndPoint.remoteState)
         (matchMVar! theirState
             [RemoteEndPointInvalid]
@@ -358,7 +462,8 @@
             [RemoteEndPointValid *vst]
             (if (connAlive.IsSet)
                 (do
-                    (vst.sendOn
+                    (acks.queued)
+                    (vst.sendPayload connId (count msg)
                         (fn [^OutputStream conn]
                             (connId.sendMsg msg conn)))
                     (return (count msg) nil))
@@ -376,17 +481,17 @@
                 (set theirState.value
                     (&RemoteEndPointClosing. (newNotifier) *vst))
                 (println "close unused connection to ", theirEndPoint.remoteAddress)
-                (vst.sendOn
+                (vst.sendClose
                     (fn [^OutputStream conn]
                         (sendCloseSocket (uint32 vst._remoteLastIncoming) conn))))))
 
     (defn getRemoteEndPoint
         ^"*RemoteEndPoint, error"
-        [^EndPointAddress theirAddress]
+        [^SocketKey key]
         (let ourState &ourEndPoint.localState)
         (matchMVar! ourState
             [LocalEndPointValid *vst]
-            (return (get vst._localConnections theirAddress) nil))
+            (return (get vst._localConnections key) nil))
         (return nil ErrEndPointClosed))
     ;; | Reset a remote endpoint if it is in Invalid mode
     ;;
@@ -400,9 +505,9 @@
     ;; Throws a TransportError ConnectFailed exception if the local endpoint is
     ;; closed.
     (defn resetIfBroken
-        [^EndPointAddress theirAddress]
+        [^SocketKey key]
         (<- theirEndPoint
-            (ourEndPoint.getRemoteEndPoint theirAddress))
+            (ourEndPoint.getRemoteEndPoint key))
         (when (not (nil? theirEndPoint))
             (let theirState &theirEndPoint.remoteState)
             (matchMVar! theirState
@@ -441,7 +546,7 @@
         [^*TCPParameters params, ^*RemoteEndPoint theirEndPoint]
         (let ourAddress ourEndPoint.localAddress
              theirAddress theirEndPoint.remoteAddress
-             [sock rsp err] (socketToEndPoint ourAddress theirAddress ourEndPoint.shakeHand))
+             [sock rsp err] (socketToEndPoint ourAddress theirAddress theirEndPoint.remoteStripe ourEndPoint.shakeHand))
         (when (not (nil? err))
             (ourEndPoint.resolveInit theirEndPoint (&RemoteEndPointInvalid. nil (err.Error)))
             (return nil err))
@@ -450,11 +555,11 @@
         (match rsp
             ConnectionRequestAccepted
             (do
-                (let st (newRemoteEndPointValid sock))
+                (let st (newRemoteEndPointValid sock params))
                 (ourEndPoint.resolveInit theirEndPoint st)
 
                 (go (st.sendRoutine))
-                (go (try (params.handleIncomingMessages ourEndPoint theirEndPoint)
+                (go (try (params.handleIncomingMessages ourEndPoint theirEndPoint sock)
                          (finally (sock.Close)))))
             
             ConnectionRequestInvalid
@@ -484,22 +589,24 @@
     ;;; | Create a new local endpoint
     ;;;
     ;;; May throw a TransportError NewEndPointErrorCode exception if the transport
-    ;;; is closed.
+    ;;; is closed. AnyEndPointId picks the next free allocated id.
     (defn createLocalEndPoint
         ^"*LocalEndPoint, error"
-        [^EndPointId epid, ^ShakeHand shake]
+        [^EndPointId wanted, ^ShakeHand shake]
         (let tpState &tp.transportState)
         (matchMVar! tpState
-            [TransPortValid vst]
+            [TransPortValid *vst]
             (do
                 (let endpoints vst._localEndPoints)
+                (<- epid (vst.endPointIdFor wanted))
                 (when (contains? endpoints epid)
                     (return nil (errors.New "endpoint already exist")))
                 (.put endpoints epid
                     (map->&LocalEndPoint {localAddress (EndPointAddress. tp.transportAddr epid)
                                           localState (^LocalEndPointState newMVar (newLocalEndPointState))
                                           localQueue (native "make(chan Event, defaultEndPointQueueCapacity)")
-                                          shakeHand shake}))
+                                          shakeHand shake
+                                          localSessions (newInboundSessions)}))
                 (return (get endpoints epid) nil)))
         (return nil ErrTransportClosed)))
 
@@ -515,7 +622,7 @@
         (set vst._remoteNextConnOutId (+ connId 1))
         vst._remoteOutgoing++
         (println "	remoteOutgoing++:", vst._remoteOutgoing)
-        (vst.sendOn
+        (vst.sendExpress
           (fn [^OutputStream conn]
             (sendCreateNewConnection (uint32 connId) conn)))
         (return connId nil))
@@ -528,6 +635,10 @@
 
     (return 0 (errors.New "newConnection")))
 
+  (defn socketKey
+    ^SocketKey []
+    (return (SocketKey. theirEndPoint.remoteAddress theirEndPoint.remoteStripe)))
+
   ;; Construct a connection ID
   (defn connId
     ^ConnectionId
@@ -666,7 +777,7 @@
           (do
             (ourEndPoint.removeRemoteEndPoint theirEndPoint)
             (set theirState.value (RemoteEndPointClosed.))
-            (vst.sendOn (fn [^OutputStream conn]
+            (vst.sendClose (fn [^OutputStream conn]
                             (sendCloseSocket (uint32 vst._remoteLastIncoming) conn)))
             (return true))))
 
@@ -723,10 +834,7 @@
             ;; report the endpoint as gone if we have any outgoing connections
             (when (> vst._remoteOutgoing 0)
               (let code (&EventConnectionLost. theirEndPoint.remoteAddress))
-              (->> "The remote endpoint was closed."
-                errors.New
-                (&ErrorEvent. code)
-                ourEndPoint.enqueue))))
+              (ourEndPoint.enqueue (&ErrorEvent. code ErrRemoteEndPointClosed)))))
 
     (let theirState &theirEndPoint.remoteState)
     (matchMVar! theirState
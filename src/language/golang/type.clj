@@ -14,6 +14,7 @@
       "ByteString" "[]byte"
       "Error" "error"
       "Chan" "chan"
+      "Duration" (do (add-import "time") "time.Duration")
       "Lock"  (do (add-import "sync") "sync.Mutex")
 
       "Listener" (do (add-import "net") "net.Listener")